@@ -12,21 +12,95 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
+	"github.com/mholt/caddy"
 )
 
 var defaultLabelPrefix = "caddy"
 
 // CaddyfileGenerator generates caddyfile
 type CaddyfileGenerator struct {
+	labelPrefix       string
 	labelRegex        *regexp.Regexp
 	proxyServiceTasks bool
 	dockerClient      *client.Client
 	caddyNetworks     map[string]bool
+	networkFilter     NetworkFilter
+	ignoreContainers  func(*types.Container) bool
+	ignoreServices    func(*swarm.Service) bool
+	staticBlocks      map[string]string
+	staticBlocksMutex sync.Mutex
+	labelTransformers []LabelTransformer
+	forceRefresh      bool
+	cacheTTL          time.Duration
+	preferIPv6        bool
+	scope             string
+	defaultSiteID     string
+	containerFilter   string
+	serviceFilter     string
+	templateTimeout   time.Duration
+	containersCache   *containersCache
+	startupProbes     *startupProbes
+}
+
+const defaultContainersCacheTTL = time.Minute
+const defaultProcessVariablesTimeout = 5 * time.Second
+
+// containersCache keeps the container list between generations, updated by docker events
+type containersCache struct {
+	sync.Mutex
+	containers map[string]*types.Container
+	updated    time.Time
+	hits       int
+	misses     int
+}
+
+var defaultJSONLogFields = []string{"remote", "when", "method", "uri", "proto", "status", "size", "latency"}
+
+var traceHeaders = map[string][]string{
+	"b3":     {"X-B3-TraceId", "X-B3-SpanId", "X-B3-ParentSpanId", "X-B3-Sampled", "X-B3-Flags"},
+	"w3c":    {"traceparent", "tracestate"},
+	"jaeger": {"uber-trace-id"},
+}
+
+var defaultProxyHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+var knownDNSProviders = map[string]bool{
+	"auroradns": true, "azure": true, "cloudflare": true, "cloudxns": true, "digitalocean": true,
+	"dnsimple": true, "dnsmadeeasy": true, "dnspod": true, "dreamhost": true, "duckdns": true,
+	"dyn": true, "exoscale": true, "gandi": true, "gandiv5": true, "godaddy": true,
+	"googlecloud": true, "lightsail": true, "linode": true, "namecheap": true, "namedotcom": true,
+	"ns1": true, "otc": true, "ovh": true, "powerdns": true, "rackspace": true,
+	"rfc2136": true, "route53": true, "vultr": true,
+}
+
+// isPluginInstalled checks if a caddy plugin, like http.cache, is built in
+var isPluginInstalled = func(name string) bool {
+	for _, plugins := range caddy.ListPlugins() {
+		for _, plugin := range plugins {
+			if plugin == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// labelAliases maps alternative label names to the labels they are converted as
+var labelAliases = map[string]string{
+	"probe_path":          "healthcheck_path",
+	"probe_interval":      "healthcheck_interval",
+	"probe_timeout":       "healthcheck_timeout",
+	"probe_expect_status": "healthcheck_expect_status",
 }
 
 var isTrue = regexp.MustCompile("(?i)^(true|yes|1)$")
@@ -34,16 +108,45 @@ var suffixRegex = regexp.MustCompile("_\\d+$")
 
 var labelPrefixFlag string
 var proxyServiceTasksFlag bool
+var forceRefreshFlag bool
+var containersCacheTTLFlag time.Duration
+var preferIPv6Flag bool
+var scopeFlag string
+var containerLabelFilterFlag string
+var serviceLabelFilterFlag string
 
 func init() {
 	flag.StringVar(&labelPrefixFlag, "docker-label-prefix", defaultLabelPrefix, "Prefix for Docker labels")
 	flag.BoolVar(&proxyServiceTasksFlag, "proxy-service-tasks", false, "Proxy to service tasks instead of VIP")
+	flag.BoolVar(&forceRefreshFlag, "force-refresh", false, "List Docker containers on every update instead of caching them")
+	flag.DurationVar(&containersCacheTTLFlag, "containers-cache-ttl", defaultContainersCacheTTL, "How long cached Docker containers are used before listing them again")
+	flag.BoolVar(&preferIPv6Flag, "prefer-ipv6", false, "Proxy to container IPv6 addresses when available")
+	flag.StringVar(&scopeFlag, "scope", "", "Scope wrapping the generated caddyfile, when multiple generators share it")
+	flag.StringVar(&containerLabelFilterFlag, "container-label-filter", "", "Docker label filter, like key=value, selecting containers to proxy")
+	flag.StringVar(&serviceLabelFilterFlag, "service-label-filter", "", "Docker label filter, like key=value, selecting services to proxy")
 }
 
 // GeneratorOptions are the options for generator
 type GeneratorOptions struct {
-	labelPrefix       string
-	proxyServiceTasks bool
+	labelPrefix        string
+	proxyServiceTasks  bool
+	forceRefresh       bool
+	containersCacheTTL time.Duration
+	preferIPv6         bool
+	scope              string
+
+	// IgnoreContainers skips containers for which it returns true
+	IgnoreContainers func(*types.Container) bool
+	// IgnoreServices skips services for which it returns true
+	IgnoreServices func(*swarm.Service) bool
+	// LabelTransformers are applied in order to labels before converting them
+	LabelTransformers []LabelTransformer
+	// ContainerLabelFilter lists only containers matching a docker label filter, like key=value
+	ContainerLabelFilter string
+	// ServiceLabelFilter lists only services matching a docker label filter, like key=value
+	ServiceLabelFilter string
+	// ProcessVariablesTimeout limits how long a label template can run, 5s by default
+	ProcessVariablesTimeout time.Duration
 }
 
 // GetGeneratorOptions creates generator options from cli flags and environment variables
@@ -62,6 +165,45 @@ func GetGeneratorOptions() *GeneratorOptions {
 		options.proxyServiceTasks = proxyServiceTasksFlag
 	}
 
+	if forceRefreshEnv := os.Getenv("CADDY_DOCKER_FORCE_REFRESH"); forceRefreshEnv != "" {
+		options.forceRefresh = isTrue.MatchString(forceRefreshEnv)
+	} else {
+		options.forceRefresh = forceRefreshFlag
+	}
+
+	options.containersCacheTTL = containersCacheTTLFlag
+	if containersCacheTTLEnv := os.Getenv("CADDY_DOCKER_CONTAINERS_CACHE_TTL"); containersCacheTTLEnv != "" {
+		if ttl, err := time.ParseDuration(containersCacheTTLEnv); err == nil {
+			options.containersCacheTTL = ttl
+		} else {
+			log.Printf("[WARNING] Invalid CADDY_DOCKER_CONTAINERS_CACHE_TTL %q, using %v\n", containersCacheTTLEnv, containersCacheTTLFlag)
+		}
+	}
+
+	if preferIPv6Env := os.Getenv("CADDY_DOCKER_PREFER_IPV6"); preferIPv6Env != "" {
+		options.preferIPv6 = isTrue.MatchString(preferIPv6Env)
+	} else {
+		options.preferIPv6 = preferIPv6Flag
+	}
+
+	if scopeEnv := os.Getenv("CADDY_DOCKER_SCOPE"); scopeEnv != "" {
+		options.scope = scopeEnv
+	} else {
+		options.scope = scopeFlag
+	}
+
+	if containerLabelFilterEnv := os.Getenv("CADDY_DOCKER_CONTAINER_LABEL_FILTER"); containerLabelFilterEnv != "" {
+		options.ContainerLabelFilter = containerLabelFilterEnv
+	} else {
+		options.ContainerLabelFilter = containerLabelFilterFlag
+	}
+
+	if serviceLabelFilterEnv := os.Getenv("CADDY_DOCKER_SERVICE_LABEL_FILTER"); serviceLabelFilterEnv != "" {
+		options.ServiceLabelFilter = serviceLabelFilterEnv
+	} else {
+		options.ServiceLabelFilter = serviceLabelFilterFlag
+	}
+
 	return &options
 }
 
@@ -71,14 +213,42 @@ func CreateGenerator(dockerClient *client.Client, options *GeneratorOptions) *Ca
 
 	generator.dockerClient = dockerClient
 
+	generator.labelPrefix = options.labelPrefix
 	var labelRegexString = fmt.Sprintf("^%s(_\\d+)?(\\.|$)", options.labelPrefix)
 	generator.labelRegex = regexp.MustCompile(labelRegexString)
 
 	generator.proxyServiceTasks = options.proxyServiceTasks
+	generator.ignoreContainers = options.IgnoreContainers
+	generator.ignoreServices = options.IgnoreServices
+	generator.labelTransformers = options.LabelTransformers
+	generator.forceRefresh = options.forceRefresh
+	generator.cacheTTL = options.containersCacheTTL
+	if generator.cacheTTL <= 0 {
+		generator.cacheTTL = defaultContainersCacheTTL
+	}
+	generator.preferIPv6 = options.preferIPv6
+	generator.scope = options.scope
+	generator.containerFilter = options.ContainerLabelFilter
+	generator.serviceFilter = options.ServiceLabelFilter
+	generator.templateTimeout = options.ProcessVariablesTimeout
+	if generator.templateTimeout <= 0 {
+		generator.templateTimeout = defaultProcessVariablesTimeout
+	}
+	generator.containersCache = &containersCache{}
+	generator.startupProbes = &startupProbes{probes: map[string]*startupProbe{}}
+	generator.networkFilter = ExcludeIngress
 
 	return &generator
 }
 
+// WithNetworkFilter replaces the filter choosing which caddy networks are used,
+// by default the ingress network is excluded
+func (g *CaddyfileGenerator) WithNetworkFilter(filter func(networkInfo types.NetworkResource) bool) *CaddyfileGenerator {
+	g.networkFilter = filter
+	g.caddyNetworks = nil
+	return g
+}
+
 // GenerateCaddyFile generates a caddy file config from docker swarm
 func (g *CaddyfileGenerator) GenerateCaddyFile() []byte {
 	var buffer bytes.Buffer
@@ -95,16 +265,19 @@ func (g *CaddyfileGenerator) GenerateCaddyFile() []byte {
 		}
 	}
 
-	containers, err := g.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
-	if err == nil {
+	containers, containersErr := g.getContainers()
+	services, err := g.dockerClient.ServiceList(context.Background(), types.ServiceListOptions{Filters: labelFilterArgs(g.serviceFilter)})
+	g.defaultSiteID = g.getDefaultSiteID(containers, services)
+
+	if containersErr == nil {
+		g.addGlobalOptions(&buffer, containers)
 		for _, container := range containers {
 			g.addContainerToCaddyFile(&buffer, &container)
 		}
 	} else {
-		g.addComment(&buffer, err.Error())
+		g.addComment(&buffer, containersErr.Error())
 	}
 
-	services, err := g.dockerClient.ServiceList(context.Background(), types.ServiceListOptions{})
 	if err == nil {
 		for _, service := range services {
 			g.addServiceToCaddyFile(&buffer, &service)
@@ -113,13 +286,275 @@ func (g *CaddyfileGenerator) GenerateCaddyFile() []byte {
 		g.addComment(&buffer, err.Error())
 	}
 
+	g.addStaticBlocks(&buffer)
+
 	if buffer.Len() == 0 {
 		buffer.WriteString("# Empty file")
 	}
 
+	if g.scope != "" {
+		return wrapScope(g.scope, buffer.Bytes())
+	}
+
+	return buffer.Bytes()
+}
+
+// addGlobalOptions reports global labels from the global config container,
+// caddy doesn't support a global options block in the caddyfile
+func (g *CaddyfileGenerator) addGlobalOptions(buffer *bytes.Buffer, containers []types.Container) {
+	var globalContainers []types.Container
+	var globalLabels map[string]string
+	for _, container := range containers {
+		labels := g.transformLabels(container.Labels)
+		if isTrue.MatchString(labels[g.labelPrefix+".global_config"]) {
+			if len(globalContainers) == 0 {
+				globalLabels = labels
+			}
+			globalContainers = append(globalContainers, container)
+		}
+	}
+	if len(globalContainers) == 0 {
+		return
+	}
+	if len(globalContainers) > 1 {
+		log.Printf("[WARNING] Multiple global config containers found, using %v\n", globalContainers[0].ID)
+	}
+
+	globalPrefix := g.labelPrefix + ".global."
+	var labels []string
+	for label := range globalLabels {
+		if strings.HasPrefix(label, globalPrefix) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		option := strings.TrimSpace(strings.TrimPrefix(label, globalPrefix) + " " + globalLabels[label])
+		g.addComment(buffer, fmt.Sprintf("global option %s ignored, caddy doesn't support a global options block, use command line flags", option))
+	}
+}
+
+// wrapScope marks the generated content as owned by a scope, so generators
+// sharing a caddyfile can find their own section
+func wrapScope(scope string, content []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("# scope:%s begin\n", scope))
+	buffer.Write(content)
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		buffer.WriteString("\n")
+	}
+	buffer.WriteString(fmt.Sprintf("# scope:%s end\n", scope))
 	return buffer.Bytes()
 }
 
+// getDefaultSiteID returns the oldest container with a default_site label, or the oldest
+// service when no container has one
+func (g *CaddyfileGenerator) getDefaultSiteID(containers []types.Container, services []swarm.Service) string {
+	var defaultContainer *types.Container
+	for i, container := range containers {
+		if g.ignoreContainers != nil && g.ignoreContainers(&containers[i]) {
+			continue
+		}
+		labels, err := g.getContainerLabels(&containers[i])
+		if err != nil || len(g.getDefaultSiteLabels(labels)) == 0 {
+			continue
+		}
+		if defaultContainer == nil || container.Created < defaultContainer.Created {
+			defaultContainer = &containers[i]
+		}
+	}
+	if defaultContainer != nil {
+		return defaultContainer.ID
+	}
+
+	var defaultService *swarm.Service
+	for i, service := range services {
+		if g.ignoreServices != nil && g.ignoreServices(&services[i]) {
+			continue
+		}
+		if len(g.getDefaultSiteLabels(g.transformLabels(service.Spec.Labels))) == 0 {
+			continue
+		}
+		if defaultService == nil || service.CreatedAt.Before(defaultService.CreatedAt) ||
+			(service.CreatedAt.Equal(defaultService.CreatedAt) && service.ID < defaultService.ID) {
+			defaultService = &services[i]
+		}
+	}
+	if defaultService != nil {
+		return defaultService.ID
+	}
+	return ""
+}
+
+var defaultSiteLabelRegex = regexp.MustCompile(`^(_\d+)?\.default_site$`)
+
+// getDefaultSiteLabels returns the enabled default_site labels of every site, sorted
+func (g *CaddyfileGenerator) getDefaultSiteLabels(labels map[string]string) []string {
+	var defaultSiteLabels []string
+	for label, value := range labels {
+		if strings.HasPrefix(label, g.labelPrefix) && defaultSiteLabelRegex.MatchString(strings.TrimPrefix(label, g.labelPrefix)) && isTrue.MatchString(value) {
+			defaultSiteLabels = append(defaultSiteLabels, label)
+		}
+	}
+	sort.Strings(defaultSiteLabels)
+	return defaultSiteLabels
+}
+
+// removeExtraDefaultSites removes default_site labels of containers and services that
+// aren't the default site, and of every site but the first of the default site
+func (g *CaddyfileGenerator) removeExtraDefaultSites(buffer *bytes.Buffer, kind string, id string, labels map[string]string) map[string]string {
+	defaultSiteLabels := g.getDefaultSiteLabels(labels)
+	if len(defaultSiteLabels) == 0 {
+		return labels
+	}
+
+	labels = copyLabels(labels)
+	if g.defaultSiteID != "" && g.defaultSiteID != id {
+		g.addComment(buffer, fmt.Sprintf("%s %v default_site ignored, %v is the default site", kind, id, g.defaultSiteID))
+		for _, label := range defaultSiteLabels {
+			delete(labels, label)
+		}
+		return labels
+	}
+	for _, label := range defaultSiteLabels[1:] {
+		g.addComment(buffer, fmt.Sprintf("%s %v %s ignored, %s is the default site", kind, id, label, defaultSiteLabels[0]))
+		delete(labels, label)
+	}
+	return labels
+}
+
+func (g *CaddyfileGenerator) getContainers() ([]types.Container, error) {
+	cache := g.containersCache
+	cache.Lock()
+	defer cache.Unlock()
+
+	if g.forceRefresh || cache.containers == nil || time.Since(cache.updated) > g.cacheTTL {
+		cache.misses++
+		containers, err := g.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{Filters: labelFilterArgs(g.containerFilter)})
+		if err != nil {
+			return nil, err
+		}
+		cache.containers = map[string]*types.Container{}
+		for i := range containers {
+			cache.containers[containers[i].ID] = &containers[i]
+		}
+		cache.updated = time.Now()
+		log.Printf("[DEBUG] Containers cache refreshed, hits: %v, misses: %v\n", cache.hits, cache.misses)
+	} else {
+		cache.hits++
+	}
+
+	var containers []types.Container
+	for _, container := range cache.containers {
+		containers = append(containers, *container)
+	}
+	// Containers with uid labels come first, sorted by uid, keeping their
+	// order stable when they are recreated with a new ID
+	uidLabel := g.labelPrefix + ".uid"
+	uids := map[string]string{}
+	for _, container := range containers {
+		if uid, ok := g.transformLabels(container.Labels)[uidLabel]; ok {
+			uids[container.ID] = uid
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		uidI, hasUIDI := uids[containers[i].ID]
+		uidJ, hasUIDJ := uids[containers[j].ID]
+		if hasUIDI != hasUIDJ {
+			return hasUIDI
+		}
+		if uidI != uidJ {
+			return uidI < uidJ
+		}
+		if containers[i].Created != containers[j].Created {
+			return containers[i].Created > containers[j].Created
+		}
+		return containers[i].ID < containers[j].ID
+	})
+	return containers, nil
+}
+
+// labelFilterArgs creates docker list filters matching a label filter, matching everything when it's empty
+func labelFilterArgs(labelFilter string) filters.Args {
+	args := filters.NewArgs()
+	if labelFilter != "" {
+		args.Add("label", labelFilter)
+	}
+	return args
+}
+
+// UpdateContainer updates the cached container after a docker container event,
+// or a network event connecting or disconnecting it
+func (g *CaddyfileGenerator) UpdateContainer(action string, containerID string) {
+	switch action {
+	case "start", "stop", "die", "destroy":
+		g.removeStartupProbe(containerID)
+	}
+
+	cache := g.containersCache
+	cache.Lock()
+	defer cache.Unlock()
+
+	if cache.containers == nil {
+		return
+	}
+
+	switch action {
+	case "start", "unpause", "connect", "disconnect":
+	case "stop", "die", "destroy":
+		delete(cache.containers, containerID)
+		return
+	default:
+		return
+	}
+
+	args := labelFilterArgs(g.containerFilter)
+	args.Add("id", containerID)
+	containers, err := g.dockerClient.ContainerList(context.Background(), types.ContainerListOptions{Filters: args})
+	if err != nil {
+		log.Printf("[ERROR] Failed to update container %v: %v\n", containerID, err)
+		cache.containers = nil
+		return
+	}
+	for i := range containers {
+		cache.containers[containers[i].ID] = &containers[i]
+	}
+}
+
+// AddStaticBlock adds a verbatim caddyfile block, replacing any block with the same name
+func (g *CaddyfileGenerator) AddStaticBlock(name, content string) {
+	g.staticBlocksMutex.Lock()
+	defer g.staticBlocksMutex.Unlock()
+
+	if g.staticBlocks == nil {
+		g.staticBlocks = map[string]string{}
+	}
+	g.staticBlocks[name] = content
+}
+
+// RemoveStaticBlock removes a block added with AddStaticBlock
+func (g *CaddyfileGenerator) RemoveStaticBlock(name string) {
+	g.staticBlocksMutex.Lock()
+	defer g.staticBlocksMutex.Unlock()
+
+	delete(g.staticBlocks, name)
+}
+
+func (g *CaddyfileGenerator) addStaticBlocks(buffer *bytes.Buffer) {
+	g.staticBlocksMutex.Lock()
+	defer g.staticBlocksMutex.Unlock()
+
+	var names []string
+	for name := range g.staticBlocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		buffer.WriteString(strings.TrimRight(g.staticBlocks[name], "\n") + "\n")
+	}
+}
+
 func getCaddyContainerID() (string, error) {
 	bytes, err := ioutil.ReadFile("/proc/self/cgroup")
 	if err != nil {
@@ -147,13 +582,17 @@ func (g *CaddyfileGenerator) getCaddyNetworks() ([]string, error) {
 		return nil, err
 	}
 
+	if g.scope == "" && container.Config != nil {
+		g.scope = g.transformLabels(container.Config.Labels)[g.labelPrefix+".scope"]
+	}
+
 	var networks []string
 	for _, network := range container.NetworkSettings.Networks {
 		networkInfo, err := g.dockerClient.NetworkInspect(context.Background(), network.NetworkID, types.NetworkInspectOptions{})
 		if err != nil {
 			return nil, err
 		}
-		if !networkInfo.Ingress {
+		if g.networkFilter(networkInfo) {
 			networks = append(networks, network.NetworkID)
 		}
 	}
@@ -169,30 +608,30 @@ func (g *CaddyfileGenerator) addComment(buffer *bytes.Buffer, text string) {
 }
 
 func (g *CaddyfileGenerator) addContainerToCaddyFile(buffer *bytes.Buffer, container *types.Container) {
-	directives, err := g.parseDirectives(container.Labels, container, func() (string, error) {
-		return g.getContainerIPAddress(container)
-	})
+	if g.ignoreContainers != nil && g.ignoreContainers(container) {
+		log.Printf("[DEBUG] Ignoring container %v\n", container.ID)
+		return
+	}
+	labels, err := g.getContainerLabels(container)
 	if err != nil {
 		g.addComment(buffer, err.Error())
 		return
 	}
-	for _, name := range getSortedKeys(&directives.children) {
-		writeDirective(buffer, directives.children[name], 0)
-	}
-}
 
-func (g *CaddyfileGenerator) getContainerIPAddress(container *types.Container) (string, error) {
-	for _, network := range container.NetworkSettings.Networks {
-		if _, isCaddyNetwork := g.caddyNetworks[network.NetworkID]; isCaddyNetwork {
-			return network.IPAddress, nil
-		}
+	started, err := g.isContainerStarted(container, labels)
+	if err != nil {
+		g.addComment(buffer, err.Error())
+		return
+	}
+	if !started {
+		g.addComment(buffer, fmt.Sprintf("Container %v waiting for startup probe", container.ID))
+		return
 	}
-	return "", fmt.Errorf("Container %v and caddy are not in same network", container.ID)
-}
 
-func (g *CaddyfileGenerator) addServiceToCaddyFile(buffer *bytes.Buffer, service *swarm.Service) {
-	directives, err := g.parseDirectives(service.Spec.Labels, service, func() (string, error) {
-		return g.getServiceProxyTarget(service)
+	labels = g.removeExtraDefaultSites(buffer, "Container", container.ID, labels)
+
+	directives, err := g.parseDirectives(labels, container, func() ([]string, error) {
+		return g.getContainerProxyTargets(container, labels)
 	})
 	if err != nil {
 		g.addComment(buffer, err.Error())
@@ -203,100 +642,2483 @@ func (g *CaddyfileGenerator) addServiceToCaddyFile(buffer *bytes.Buffer, service
 	}
 }
 
-func (g *CaddyfileGenerator) getServiceProxyTarget(service *swarm.Service) (string, error) {
-	_, err := g.getServiceIPAddress(service)
-	if err != nil {
-		return "", err
+// getContainerProxyTargets returns the addresses traffic to a container is proxied to,
+// following the link, network_alias, prefer_ipv6 and docker_net labels
+func (g *CaddyfileGenerator) getContainerProxyTargets(container *types.Container, labels map[string]string) ([]string, error) {
+	target := container
+	if link, ok := labels[g.labelPrefix+".link"]; ok {
+		var err error
+		target, err = g.getLinkedContainer(container, link)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	if g.proxyServiceTasks {
-		return "tasks." + service.Spec.Name, nil
+	if networkAlias, ok := labels[g.labelPrefix+".network_alias"]; ok {
+		alias, err := g.getContainerNetworkAlias(target, networkAlias)
+		if err != nil {
+			return nil, err
+		}
+		return []string{alias}, nil
 	}
-
-	return service.Spec.Name, nil
-}
-
-func (g *CaddyfileGenerator) getServiceIPAddress(service *swarm.Service) (string, error) {
-	for _, virtualIP := range service.Endpoint.VirtualIPs {
-		if _, isCaddyNetwork := g.caddyNetworks[virtualIP.NetworkID]; isCaddyNetwork {
-			return virtualIP.Addr, nil
+	preferIPv6 := g.preferIPv6
+	if preferIPv6Label, ok := labels[g.labelPrefix+".prefer_ipv6"]; ok {
+		preferIPv6 = isTrue.MatchString(preferIPv6Label)
+	}
+	if dockerNet, ok := labels[g.labelPrefix+".docker_net"]; ok {
+		ipAddress, err := g.getContainerNetworkIPAddress(target, dockerNet, preferIPv6)
+		if err != nil {
+			return nil, err
 		}
+		return []string{ipAddress}, nil
 	}
-	return "", fmt.Errorf("Service %v and caddy are not in same network", service.ID)
+	ipAddress, err := g.getContainerIPAddress(target, preferIPv6)
+	if err != nil {
+		return nil, err
+	}
+	return []string{ipAddress}, nil
 }
 
-func (g *CaddyfileGenerator) parseDirectives(labels map[string]string, templateData interface{}, getProxyTarget func() (string, error)) (*directiveData, error) {
-	rootDirective := &directiveData{}
+func copyLabels(labels map[string]string) map[string]string {
+	copied := map[string]string{}
+	for label, value := range labels {
+		copied[label] = value
+	}
+	return copied
+}
 
-	g.convertLabelsToDirectives(labels, templateData, rootDirective)
+// getLinkedContainer finds the container traffic is proxied to instead of the
+// labeled one, by name or ID, in the containers cache
+func (g *CaddyfileGenerator) getLinkedContainer(container *types.Container, link string) (*types.Container, error) {
+	cache := g.containersCache
+	cache.Lock()
+	defer cache.Unlock()
 
-	//Convert basic labels
-	for _, directive := range rootDirective.children {
-		address := directive.children["address"]
-		if address != nil {
-			directive.name = address.args
+	for _, linked := range cache.containers {
+		if linked.ID == link {
+			return linked, nil
 		}
-
-		targetPort := directive.children["targetport"]
-		targetPath := directive.children["targetpath"]
-		targetProtocol := directive.children["targetprotocol"]
-		if targetPort != nil || targetProtocol != nil {
-			proxyDirective := getOrCreateDirective(directive, "proxy")
-			proxyTarget, err := getProxyTarget()
-			if err != nil {
-				return nil, err
-			}
-
-			proxyDirective.args = "/ "
-
-			if targetProtocol != nil {
-				proxyDirective.args += targetProtocol.args + "://"
-			}
-
-			proxyDirective.args += fmt.Sprintf("%s:%s", proxyTarget, targetPort.args)
-
-			if targetPath != nil {
-				proxyDirective.args += targetPath.args
+		for _, name := range linked.Names {
+			if strings.TrimPrefix(name, "/") == link {
+				return linked, nil
 			}
 		}
+	}
+	return nil, fmt.Errorf("Container %v links to %v, which is not running", container.ID, link)
+}
 
-		delete(directive.children, "address")
-		delete(directive.children, "targetport")
-		delete(directive.children, "targetpath")
-		delete(directive.children, "targetprotocol")
+// getContainerLabels returns the transformed container labels, merged with the labels
+// of the containers it inherits from
+func (g *CaddyfileGenerator) getContainerLabels(container *types.Container) (map[string]string, error) {
+	labels := g.transformLabels(container.Labels)
+	if _, inherits := labels[g.labelPrefix+".inherit_from"]; !inherits {
+		return labels, nil
 	}
+	return mergeInheritedLabels(container.ID, labels, g.labelPrefix+".inherit_from", func(reference string) (string, map[string]string, error) {
+		parent, err := g.dockerClient.ContainerInspect(context.Background(), reference)
+		if err != nil {
+			return "", nil, err
+		}
+		return parent.ID, g.transformLabels(parent.Config.Labels), nil
+	})
+}
 
-	return rootDirective, nil
+// transformLabels applies the label transformers, before any label is read
+func (g *CaddyfileGenerator) transformLabels(labels map[string]string) map[string]string {
+	for _, transformer := range g.labelTransformers {
+		labels = transformer.Transform(labels)
+	}
+	return labels
 }
 
-func getOrCreateDirective(directive *directiveData, path string) *directiveData {
-	currentDirective := directive
+// mergeInheritedLabels follows the inherit label chain, labels closer to the container take precedence
+func mergeInheritedLabels(containerID string, labels map[string]string, inheritLabel string, inspect func(string) (string, map[string]string, error)) (map[string]string, error) {
+	visited := map[string]bool{containerID: true}
+	chain := []map[string]string{labels}
+	current := labels
+	for {
+		reference, ok := current[inheritLabel]
+		if !ok {
+			break
+		}
+		parentID, parentLabels, err := inspect(reference)
+		if err != nil {
+			return nil, err
+		}
+		if visited[parentID] {
+			return nil, fmt.Errorf("Container %v has circular inheritance through %v", containerID, reference)
+		}
+		visited[parentID] = true
+		chain = append(chain, parentLabels)
+		current = parentLabels
+	}
 
-	for _, p := range strings.Split(path, ".") {
-		if d, ok := currentDirective.children[p]; ok {
-			currentDirective = d
-		} else {
-			if currentDirective.children == nil {
-				currentDirective.children = map[string]*directiveData{}
-			}
-			var newDirective = directiveData{}
-			newDirective.name = removeSuffix(p)
-			currentDirective.children[p] = &newDirective
-			currentDirective = &newDirective
+	merged := map[string]string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		for label, value := range chain[i] {
+			merged[label] = value
 		}
 	}
+	delete(merged, inheritLabel)
+	return merged, nil
+}
 
-	return currentDirective
+func (g *CaddyfileGenerator) getContainerIPAddress(container *types.Container, preferIPv6 bool) (string, error) {
+	for _, network := range container.NetworkSettings.Networks {
+		if _, isCaddyNetwork := g.caddyNetworks[network.NetworkID]; isCaddyNetwork {
+			return getEndpointIPAddress(network, preferIPv6), nil
+		}
+	}
+	return "", fmt.Errorf("Container %v and caddy are not in same network", container.ID)
 }
 
-func (g *CaddyfileGenerator) convertLabelsToDirectives(labels map[string]string, templateData interface{}, rootDirective *directiveData) {
-	for label, value := range labels {
-		if !g.labelRegex.MatchString(label) {
+// getContainerNetworkAlias returns the first alias of the container in caddy
+// network, or the requested alias after checking the container has it
+func (g *CaddyfileGenerator) getContainerNetworkAlias(container *types.Container, networkAlias string) (string, error) {
+	for _, network := range container.NetworkSettings.Networks {
+		if _, isCaddyNetwork := g.caddyNetworks[network.NetworkID]; !isCaddyNetwork {
 			continue
 		}
-		directive := rootDirective
-		path := strings.Split(label, ".")
-		for i, p := range path {
+		for _, alias := range network.Aliases {
+			if isTrue.MatchString(networkAlias) || alias == networkAlias {
+				return alias, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Container %v has no network alias %v in caddy network", container.ID, networkAlias)
+}
+
+// getContainerNetworkIPAddress returns the container IP in a specific caddy network,
+// identified by name or ID
+func (g *CaddyfileGenerator) getContainerNetworkIPAddress(container *types.Container, networkName string, preferIPv6 bool) (string, error) {
+	network, ok := container.NetworkSettings.Networks[networkName]
+	if !ok {
+		networkInfo, err := g.dockerClient.NetworkInspect(context.Background(), networkName, types.NetworkInspectOptions{})
+		if err != nil {
+			return "", err
+		}
+		for _, containerNetwork := range container.NetworkSettings.Networks {
+			if containerNetwork.NetworkID == networkInfo.ID {
+				network = containerNetwork
+			}
+		}
+		if network == nil {
+			return "", fmt.Errorf("Container %v is not in network %v", container.ID, networkName)
+		}
+	}
+	if _, isCaddyNetwork := g.caddyNetworks[network.NetworkID]; !isCaddyNetwork {
+		return "", fmt.Errorf("Network %v of container %v is not a caddy network", networkName, container.ID)
+	}
+	return getEndpointIPAddress(network, preferIPv6), nil
+}
+
+// getEndpointIPAddress returns the IPv6 address in brackets when preferred and
+// available, otherwise the IPv4 address
+func getEndpointIPAddress(endpoint *network.EndpointSettings, preferIPv6 bool) string {
+	if preferIPv6 && endpoint.GlobalIPv6Address != "" {
+		return "[" + endpoint.GlobalIPv6Address + "]"
+	}
+	return endpoint.IPAddress
+}
+
+func (g *CaddyfileGenerator) addServiceToCaddyFile(buffer *bytes.Buffer, service *swarm.Service) {
+	if g.ignoreServices != nil && g.ignoreServices(service) {
+		log.Printf("[DEBUG] Ignoring service %v\n", service.ID)
+		return
+	}
+	labels := g.removeExtraDefaultSites(buffer, "Service", service.ID, g.transformLabels(service.Spec.Labels))
+	proxyServiceTasks, err := g.getServiceProxyServiceTasks(labels)
+	if err != nil {
+		g.addComment(buffer, err.Error())
+		return
+	}
+	discoveryMode, err := g.getServiceDiscoveryMode(labels)
+	if err != nil {
+		g.addComment(buffer, err.Error())
+		return
+	}
+	directives, err := g.parseDirectives(labels, service, func() ([]string, error) {
+		return g.getServiceProxyTargets(service, labels, discoveryMode, proxyServiceTasks)
+	})
+	if err != nil {
+		g.addComment(buffer, err.Error())
+		return
+	}
+	for _, name := range getSortedKeys(&directives.children) {
+		writeDirective(buffer, directives.children[name], 0)
+	}
+}
+
+func (g *CaddyfileGenerator) getServiceProxyServiceTasks(labels map[string]string) (bool, error) {
+	switch policy := labels[g.labelPrefix+".service_policy"]; policy {
+	case "":
+		return g.proxyServiceTasks, nil
+	case "tasks":
+		return true, nil
+	case "vip":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid service_policy %q, expected vip or tasks", policy)
+	}
+}
+
+func (g *CaddyfileGenerator) getServiceDiscoveryMode(labels map[string]string) (string, error) {
+	switch mode := labels[g.labelPrefix+".service_discovery_mode"]; mode {
+	case "":
+		return "dns", nil
+	case "dns", "ip", "task_ips":
+		return mode, nil
+	default:
+		return "", fmt.Errorf("Invalid service_discovery_mode %q, expected dns, ip or task_ips", mode)
+	}
+}
+
+func (g *CaddyfileGenerator) getServiceProxyTargets(service *swarm.Service, labels map[string]string, discoveryMode string, proxyServiceTasks bool) ([]string, error) {
+	ipAddress, err := g.getServiceIPAddress(service)
+	if err != nil {
+		return nil, err
+	}
+
+	switch discoveryMode {
+	case "ip":
+		return []string{stripPrefixLength(ipAddress)}, nil
+	case "task_ips":
+		return g.getServiceTasksIPAddresses(service)
+	}
+
+	serviceName := service.Spec.Name
+	if nameOverride := labels[g.labelPrefix+".service_name_override"]; nameOverride != "" {
+		serviceName = nameOverride
+	}
+
+	if proxyServiceTasks {
+		return []string{"tasks." + serviceName}, nil
+	}
+
+	return []string{serviceName}, nil
+}
+
+// listServiceTasks lists tasks of a service that should be running
+var listServiceTasks = func(dockerClient *client.Client, serviceID string) ([]swarm.Task, error) {
+	args := filters.NewArgs()
+	args.Add("service", serviceID)
+	args.Add("desired-state", "running")
+	return dockerClient.TaskList(context.Background(), types.TaskListOptions{Filters: args})
+}
+
+func (g *CaddyfileGenerator) getServiceTasksIPAddresses(service *swarm.Service) ([]string, error) {
+	tasks, err := listServiceTasks(g.dockerClient, service.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAddresses := []string{}
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		for _, attachment := range task.NetworksAttachments {
+			if _, isCaddyNetwork := g.caddyNetworks[attachment.Network.ID]; !isCaddyNetwork {
+				continue
+			}
+			if len(attachment.Addresses) > 0 {
+				ipAddresses = append(ipAddresses, stripPrefixLength(attachment.Addresses[0]))
+			}
+			break
+		}
+	}
+	if len(ipAddresses) == 0 {
+		return nil, fmt.Errorf("Service %v has no running tasks in caddy network", service.ID)
+	}
+	sort.Strings(ipAddresses)
+	return ipAddresses, nil
+}
+
+func (g *CaddyfileGenerator) getServiceIPAddress(service *swarm.Service) (string, error) {
+	if len(service.Endpoint.VirtualIPs) == 0 {
+		ipAddresses, err := g.getServiceTasksIPAddresses(service)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("[WARNING] Service %v has no VIP, DNS round-robin detected, using task IP %v\n", service.ID, ipAddresses[0])
+		return ipAddresses[0], nil
+	}
+	for _, virtualIP := range service.Endpoint.VirtualIPs {
+		if _, isCaddyNetwork := g.caddyNetworks[virtualIP.NetworkID]; isCaddyNetwork {
+			return virtualIP.Addr, nil
+		}
+	}
+	return "", fmt.Errorf("Service %v and caddy are not in same network", service.ID)
+}
+
+// stripPrefixLength removes the network mask from addresses in CIDR notation
+func stripPrefixLength(address string) string {
+	if index := strings.Index(address, "/"); index >= 0 {
+		return address[:index]
+	}
+	return address
+}
+
+func (g *CaddyfileGenerator) parseDirectives(labels map[string]string, templateData interface{}, getProxyTargets func() ([]string, error)) (*directiveData, error) {
+	rootDirective := &directiveData{}
+
+	g.convertLabelsToDirectives(labels, templateData, rootDirective)
+
+	targetName := getTargetName(templateData)
+
+	extraSites := map[string]*directiveData{}
+
+	//Convert basic labels
+	for key, directive := range rootDirective.children {
+		normalizeLabelAliases(directive)
+
+		if directive.children["global"] != nil || directive.children["global_config"] != nil {
+			// Global options are written by addGlobalOptions
+			delete(directive.children, "global")
+			delete(directive.children, "global_config")
+			if directive.args == "" && len(directive.children) == 0 {
+				delete(rootDirective.children, key)
+				continue
+			}
+		}
+
+		address := directive.children["address"]
+		if address != nil {
+			directive.name = address.args
+		}
+		if defaultSite := directive.children["default_site"]; defaultSite != nil {
+			if isTrue.MatchString(defaultSite.args) {
+				directive.name = ":80"
+			}
+			delete(directive.children, "default_site")
+		}
+
+		targetPort := directive.children["targetport"]
+		targetPath := directive.children["targetpath"]
+		targetProtocol := directive.children["targetprotocol"]
+		if staticFileServer := directive.children["static_file_server"]; staticFileServer != nil {
+			if err := convertStaticFileServer(directive, staticFileServer); err != nil {
+				return nil, err
+			}
+		} else if targetPort != nil || targetProtocol != nil {
+			proxyDirective := getOrCreateDirective(directive, "proxy")
+			proxyTargets, err := getProxyTargets()
+			if err != nil {
+				return nil, err
+			}
+
+			proxyDirective.args = "/"
+
+			for _, proxyTarget := range proxyTargets {
+				proxyDirective.args += " "
+
+				if targetProtocol != nil {
+					proxyDirective.args += targetProtocol.args + "://"
+				}
+
+				proxyDirective.args += fmt.Sprintf("%s:%s", proxyTarget, targetPort.args)
+
+				if targetPath != nil {
+					proxyDirective.args += targetPath.args
+				}
+			}
+		}
+
+		delete(directive.children, "address")
+		delete(directive.children, "targetport")
+		delete(directive.children, "targetpath")
+		delete(directive.children, "targetprotocol")
+		delete(directive.children, "service_policy")
+		delete(directive.children, "service_discovery_mode")
+		delete(directive.children, "network_alias")
+		delete(directive.children, "uid")
+		delete(directive.children, "docker_net")
+		delete(directive.children, "service_name_override")
+		delete(directive.children, "link")
+		delete(directive.children, "prefer_ipv6")
+		delete(directive.children, "startup_probe")
+
+		if err := convertAuthDelay(directive); err != nil {
+			return nil, err
+		}
+		if err := convertUpstreamHeaders(directive); err != nil {
+			return nil, err
+		}
+		if err := convertRequestTransform(directive); err != nil {
+			return nil, err
+		}
+		if err := convertDownstreamHeaders(directive); err != nil {
+			return nil, err
+		}
+		if err := convertRewriteResponseHeaders(directive); err != nil {
+			return nil, err
+		}
+		if err := convertXFH(directive); err != nil {
+			return nil, err
+		}
+		if err := convertHostHeader(directive); err != nil {
+			return nil, err
+		}
+		if err := convertStripProxyHeaders(directive); err != nil {
+			return nil, err
+		}
+		if err := convertUpstreamCompression(directive); err != nil {
+			return nil, err
+		}
+		if err := convertCookieAttributes(directive); err != nil {
+			return nil, err
+		}
+		convertRemovedResponseHeaders(directive, "strip_headers_from_backend")
+		convertRemovedResponseHeaders(directive, "exclude_from_global_headers")
+		if err := convertRobots(directive); err != nil {
+			return nil, err
+		}
+		if err := convertHostAliases(directive); err != nil {
+			return nil, err
+		}
+		if err := convertPort(directive); err != nil {
+			return nil, err
+		}
+		convertAcmeIssuer(directive)
+		if err := convertMaxConnections(directive); err != nil {
+			return nil, err
+		}
+		if err := convertKeepalive(directive); err != nil {
+			return nil, err
+		}
+		if err := convertHealthCheck(directive); err != nil {
+			return nil, err
+		}
+		if err := convertUpstreamIdleTimeout(directive); err != nil {
+			return nil, err
+		}
+		if err := convertUpstreamKeepaliveCount(directive); err != nil {
+			return nil, err
+		}
+		convertAccessLogFormat(directive)
+		convertLogRequestBody(directive)
+		if err := convertLogToFile(directive); err != nil {
+			return nil, err
+		}
+		convertLogSkipPaths(directive)
+		convertPush(directive)
+		convertBrowse(directive)
+		convertCORSPreflightMaxAge(directive)
+		convertTLSInsecureSkipVerify(directive, targetName)
+		if err := convertWebsocket(directive); err != nil {
+			return nil, err
+		}
+		if err := convertTrace(directive); err != nil {
+			return nil, err
+		}
+		convertCompressTypes(directive)
+		if err := convertCompressLevel(directive); err != nil {
+			return nil, err
+		}
+		convertDNS(directive)
+		if err := convertClientCert(directive); err != nil {
+			return nil, err
+		}
+		if err := convertTimeout(directive); err != nil {
+			return nil, err
+		}
+		if err := convertTLSVersions(directive); err != nil {
+			return nil, err
+		}
+		if err := convertRedirectScheme(directive); err != nil {
+			return nil, err
+		}
+		if err := convertAutoHTTPS(directive); err != nil {
+			return nil, err
+		}
+		if err := convertRedirectTrailingSlash(directive); err != nil {
+			return nil, err
+		}
+		convertDenyPaths(directive)
+		if err := convertAllowPaths(directive); err != nil {
+			return nil, err
+		}
+		if err := convertPathMatcher(directive); err != nil {
+			return nil, err
+		}
+		convertCache(directive)
+		if err := convertRateLimit(directive); err != nil {
+			return nil, err
+		}
+		if err := convertRequestRate(directive); err != nil {
+			return nil, err
+		}
+		convertMetricsPath(directive)
+		convertMetricsLabels(directive)
+		convertTrustedProxiesCloudflare(directive)
+		if err := convertInternal(directive); err != nil {
+			return nil, err
+		}
+		if err := convertResponseTransforms(directive); err != nil {
+			return nil, err
+		}
+		if err := convertPprof(directive, getProxyTargets); err != nil {
+			return nil, err
+		}
+		if err := convertCircuitBreaker(directive); err != nil {
+			return nil, err
+		}
+		if err := convertRetryPolicy(directive); err != nil {
+			return nil, err
+		}
+		if err := convertFallback(directive); err != nil {
+			return nil, err
+		}
+		if err := convertErrorHandlers(directive); err != nil {
+			return nil, err
+		}
+		removeUnsupportedLabel(directive, "log_sampler", "caddy log doesn't support sampling")
+		removeUnsupportedLabel(directive, "proxy_protocol", "caddy proxy can't send PROXY protocol headers to upstreams")
+		removeUnsupportedLabel(directive, "map", "caddy doesn't support choosing upstreams with a map directive")
+		removeUnsupportedLabel(directive, "buffer_requests", "caddy proxy always streams requests to upstreams")
+		removeUnsupportedLabel(directive, "buffer_responses", "caddy proxy always streams responses from upstreams")
+		removeUnsupportedLabel(directive, "set_header_if", "caddy header can't set a header only when it's missing")
+		removeUnsupportedLabel(directive, "tracing", "caddy can't create tracing spans, use caddy.trace to propagate trace headers")
+		removeUnsupportedLabel(directive, "sni_routing", "caddy can't route TLS connections by SNI without terminating TLS")
+		removeUnsupportedLabel(directive, "request_log_condition", "caddy log can't filter requests by status or latency, use caddy.log_skip_paths to exclude paths")
+		removeUnsupportedLabel(directive, "graceful_drain", "caddy proxy can't drain upstreams, in-flight requests finish during graceful reloads limited by caddy -grace flag")
+		removeUnsupportedLabel(directive, "x_accel_redirect", "caddy proxy can't serve files referenced by upstream response headers")
+		removeUnsupportedLabel(directive, "tls_server_name", "caddy proxy sends the upstream address as TLS server name, use a target that matches the upstream certificate")
+		removeUnsupportedLabel(directive, "content_length_limit", "caddy limits can only limit request bodies, not upstream responses")
+		removeUnsupportedLabel(directive, "log_sampling_first", "caddy log doesn't support sampling, use caddy.log_skip_paths to exclude noisy paths")
+		removeUnsupportedLabel(directive, "log_sampling_thereafter", "caddy log doesn't support sampling, use caddy.log_skip_paths to exclude noisy paths")
+		removeUnsupportedLabel(directive, "abort_on_error", "caddy can't close connections on errors, use caddy.error_handler to serve generic error pages")
+		convertCustomDirectives(directive)
+		convertPaths(directive)
+
+		for redirectKey, redirectSite := range convertRedirectFrom(directive) {
+			extraSites[key+"."+redirectKey] = redirectSite
+		}
+		subdomainSites, err := convertSubdomainRouting(directive)
+		if err != nil {
+			return nil, err
+		}
+		for subdomain, subdomainSite := range subdomainSites {
+			extraSites[key+".subdomain_routing."+subdomain] = subdomainSite
+		}
+	}
+
+	for key, extraSite := range extraSites {
+		rootDirective.children[key] = extraSite
+	}
+
+	return rootDirective, nil
+}
+
+func validateDuration(label string, value string) error {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("Invalid %s %q, expected a duration like 500ms", label, value)
+	}
+	return nil
+}
+
+func getTargetName(templateData interface{}) string {
+	switch target := templateData.(type) {
+	case *types.Container:
+		if len(target.Names) > 0 {
+			return strings.TrimPrefix(target.Names[0], "/")
+		}
+		return target.ID
+	case *swarm.Service:
+		return target.Spec.Name
+	}
+	return ""
+}
+
+func convertAuthDelay(directive *directiveData) error {
+	authDelay := directive.children["auth_delay"]
+	if authDelay == nil {
+		return nil
+	}
+	delete(directive.children, "auth_delay")
+
+	if err := validateDuration("auth_delay", authDelay.args); err != nil {
+		return err
+	}
+	if !isPluginInstalled("http.delay") {
+		directive.comments = append(directive.comments, "auth_delay ignored, install the http.delay plugin to delay responses")
+		return nil
+	}
+
+	delayPath := "/"
+	if path := authDelay.children["path"]; path != nil {
+		delayPath = path.args
+	}
+
+	delayDirective := getOrCreateDirective(directive, "delay")
+	delayDirective.args = fmt.Sprintf("%s %s", delayPath, authDelay.args)
+	return nil
+}
+
+func convertUpstreamHeaders(directive *directiveData) error {
+	upstreamHeaders := directive.children["upstream_headers"]
+	deleteUpstreamHeaders := directive.children["delete_upstream_headers"]
+	hideHeaders := directive.children["hide_headers"]
+	if upstreamHeaders == nil && deleteUpstreamHeaders == nil && hideHeaders == nil {
+		return nil
+	}
+	delete(directive.children, "upstream_headers")
+	delete(directive.children, "delete_upstream_headers")
+	delete(directive.children, "hide_headers")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "upstream_headers")
+	if err != nil {
+		return err
+	}
+	if upstreamHeaders != nil {
+		for _, key := range getSortedKeys(&upstreamHeaders.children) {
+			header := upstreamHeaders.children[key]
+			addChildDirective(proxyDirective, "header_upstream "+key, "header_upstream", header.name+" "+quoteArg(header.args))
+		}
+	}
+	for _, removedHeaders := range []*directiveData{deleteUpstreamHeaders, hideHeaders} {
+		if removedHeaders == nil {
+			continue
+		}
+		for _, header := range strings.Fields(removedHeaders.args) {
+			addChildDirective(proxyDirective, "header_upstream -"+header, "header_upstream", "-"+header)
+		}
+	}
+	return nil
+}
+
+// convertStripProxyHeaders removes X-Forwarded headers from requests sent to the upstream
+func convertStripProxyHeaders(directive *directiveData) error {
+	stripProxyHeaders := directive.children["strip_proxy_headers"]
+	if stripProxyHeaders == nil {
+		return nil
+	}
+	delete(directive.children, "strip_proxy_headers")
+
+	headers := strings.Fields(stripProxyHeaders.args)
+	if isTrue.MatchString(stripProxyHeaders.args) {
+		headers = defaultProxyHeaders
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+
+	proxyDirective, err := getTargetProxyDirective(directive, "strip_proxy_headers")
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		addChildDirective(proxyDirective, "header_upstream -"+header, "header_upstream", "-"+header)
+	}
+	return nil
+}
+
+// convertXFH forwards the original host to the upstream in X-Forwarded-Host, or strips the header
+func convertXFH(directive *directiveData) error {
+	xfh := directive.children["xfh"]
+	if xfh == nil {
+		return nil
+	}
+	delete(directive.children, "xfh")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "xfh")
+	if err != nil {
+		return err
+	}
+	switch {
+	case isTrue.MatchString(xfh.args):
+		addChildDirective(proxyDirective, "header_upstream X-Forwarded-Host", "header_upstream", "X-Forwarded-Host {host}")
+	case xfh.args == "off":
+		addChildDirective(proxyDirective, "header_upstream -X-Forwarded-Host", "header_upstream", "-X-Forwarded-Host")
+	default:
+		return fmt.Errorf("Invalid xfh %q, expected 1 or off", xfh.args)
+	}
+	return nil
+}
+
+// convertHostHeader overrides the Host header sent to the upstream
+func convertHostHeader(directive *directiveData) error {
+	hostHeader := directive.children["host_header"]
+	if hostHeader == nil {
+		return nil
+	}
+	delete(directive.children, "host_header")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "host_header")
+	if err != nil {
+		return err
+	}
+	switch hostHeader.args {
+	case "":
+		return fmt.Errorf("Invalid host_header %q, expected a host, {http.request.host} or upstream", hostHeader.args)
+	case "upstream":
+		// caddy proxy sends the upstream address as Host by default
+	case "{http.request.host}":
+		addChildDirective(proxyDirective, "header_upstream Host", "header_upstream", "Host {host}")
+	default:
+		addChildDirective(proxyDirective, "header_upstream Host", "header_upstream", "Host "+quoteArg(hostHeader.args))
+	}
+	return nil
+}
+
+// convertUpstreamCompression negotiates compressed responses with the upstream, or disables them
+func convertUpstreamCompression(directive *directiveData) error {
+	upstreamCompression := directive.children["upstream_compression"]
+	if upstreamCompression == nil {
+		return nil
+	}
+	delete(directive.children, "upstream_compression")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "upstream_compression")
+	if err != nil {
+		return err
+	}
+	switch {
+	case isTrue.MatchString(upstreamCompression.args):
+		addChildDirective(proxyDirective, "header_upstream Accept-Encoding", "header_upstream", "Accept-Encoding "+quoteArg("gzip,deflate,br"))
+		proxyDirective.comments = append(proxyDirective.comments,
+			"upstream_compression forwards compressed responses as is, clients must accept gzip, deflate and br")
+	case upstreamCompression.args == "off":
+		addChildDirective(proxyDirective, "header_upstream -Accept-Encoding", "header_upstream", "-Accept-Encoding")
+	default:
+		return fmt.Errorf("Invalid upstream_compression %q, expected 1 or off", upstreamCompression.args)
+	}
+	return nil
+}
+
+// convertCookieAttributes appends Secure and SameSite attributes to cookies
+// set by the upstream, replacing Set-Cookie response headers
+func convertCookieAttributes(directive *directiveData) error {
+	cookieSecure := directive.children["cookie_secure"]
+	cookieSameSite := directive.children["cookie_samesite"]
+	if cookieSecure == nil && cookieSameSite == nil {
+		return nil
+	}
+	delete(directive.children, "cookie_secure")
+	delete(directive.children, "cookie_samesite")
+
+	var attributes []string
+	if cookieSecure != nil && isTrue.MatchString(cookieSecure.args) {
+		attributes = append(attributes, "Secure")
+	}
+	if cookieSameSite != nil {
+		switch cookieSameSite.args {
+		case "Strict", "Lax", "None":
+			attributes = append(attributes, "SameSite="+cookieSameSite.args)
+		default:
+			return fmt.Errorf("Invalid cookie_samesite %q, expected Strict, Lax or None", cookieSameSite.args)
+		}
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+
+	proxyDirective, err := getTargetProxyDirective(directive, "cookie attributes")
+	if err != nil {
+		return err
+	}
+	addChildDirective(proxyDirective, "header_downstream Set-Cookie", "header_downstream",
+		fmt.Sprintf(`Set-Cookie "^(.*)$" "$1; %s"`, strings.Join(attributes, "; ")))
+	return nil
+}
+
+// convertRemovedResponseHeaders removes the response headers listed in a label at site level,
+// so they are removed from responses of every directive, not only the proxy, including
+// headers added to every site by global configuration
+func convertRemovedResponseHeaders(directive *directiveData, label string) {
+	removedHeaders := directive.children[label]
+	if removedHeaders == nil {
+		return
+	}
+	delete(directive.children, label)
+
+	headers := strings.Fields(removedHeaders.args)
+	if len(headers) == 0 {
+		return
+	}
+
+	headerDirective := addChildDirective(directive, "header "+label, "header", "/")
+	for _, header := range headers {
+		addChildDirective(headerDirective, "-"+header, "-"+header, "")
+	}
+}
+
+// convertRobots blocks search engine indexing with the X-Robots-Tag header,
+// caddy can't respond robots.txt without a file
+func convertRobots(directive *directiveData) error {
+	robots := directive.children["robots"]
+	if robots == nil {
+		return nil
+	}
+	delete(directive.children, "robots")
+
+	switch robots.args {
+	case "passthrough":
+	case "deny_all":
+		addChildDirective(directive, "header robots", "header", `/ X-Robots-Tag "noindex, nofollow"`)
+	case "allow_all":
+		directive.comments = append(directive.comments, "robots allow_all ignored, caddy can't respond robots.txt without a file")
+	default:
+		return fmt.Errorf("Invalid robots %q, expected deny_all, allow_all or passthrough", robots.args)
+	}
+	return nil
+}
+
+// convertRequestTransform rewrites request URLs matching a regex and sets
+// headers of requests sent to the upstream
+func convertRequestTransform(directive *directiveData) error {
+	requestTransform := directive.children["request_transform"]
+	if requestTransform == nil {
+		return nil
+	}
+	delete(directive.children, "request_transform")
+
+	if url := requestTransform.children["url"]; url != nil {
+		fields := getRequestTransformURLFields(url.args)
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid request_transform.url %q, expected a regex and a destination", url.args)
+		}
+		if _, err := regexp.Compile(fields[0]); err != nil {
+			return fmt.Errorf("Invalid request_transform.url %q, %v", url.args, err)
+		}
+		rewriteDirective, err := addRewriteDirective(directive, "request_transform.url", "")
+		if err != nil {
+			return err
+		}
+		addChildDirective(rewriteDirective, "regex", "regex", fields[0])
+		addChildDirective(rewriteDirective, "to", "to", regexpGroupPlaceholderRegex.ReplaceAllString(fields[1], "{$1}"))
+	}
+	if headers := requestTransform.children["header"]; headers != nil {
+		proxyDirective, err := getTargetProxyDirective(directive, "request_transform.header")
+		if err != nil {
+			return err
+		}
+		for _, key := range getSortedKeys(&headers.children) {
+			header := headers.children[key]
+			addChildDirective(proxyDirective, "header_upstream "+key, "header_upstream", header.name+" "+quoteArg(header.args))
+		}
+	}
+	return nil
+}
+
+var regexpGroupPlaceholderRegex = regexp.MustCompile(`\{http\.regexp\.(\d+)\}`)
+
+// getRequestTransformURLFields returns the regex and destination of a request_transform.url,
+// also accepting the caddy v2 form rewrite {path_regexp <regex> <destination>}
+func getRequestTransformURLFields(value string) []string {
+	value = strings.TrimSpace(value)
+	if fields := strings.Fields(value); len(fields) > 0 && fields[0] == "rewrite" {
+		value = strings.TrimSpace(strings.TrimPrefix(value, "rewrite"))
+		if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+			value = value[1 : len(value)-1]
+		}
+	}
+	fields := strings.Fields(value)
+	if len(fields) > 0 && fields[0] == "path_regexp" {
+		fields = fields[1:]
+	}
+	return fields
+}
+
+func convertDownstreamHeaders(directive *directiveData) error {
+	downstreamHeaders := directive.children["downstream_headers"]
+	if downstreamHeaders == nil {
+		return nil
+	}
+	delete(directive.children, "downstream_headers")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "downstream_headers")
+	if err != nil {
+		return err
+	}
+	for _, key := range getSortedKeys(&downstreamHeaders.children) {
+		header := downstreamHeaders.children[key]
+		if header.args == "~" {
+			addChildDirective(proxyDirective, "header_downstream -"+key, "header_downstream", "-"+header.name)
+		} else {
+			addChildDirective(proxyDirective, "header_downstream "+key, "header_downstream", header.name+" "+quoteArg(header.args))
+		}
+	}
+	return nil
+}
+
+var sedBackReferenceRegex = regexp.MustCompile(`\\(\d)`)
+
+// convertRewriteResponseHeaders replaces text of response headers coming from the upstream
+// with sed like expressions, s|find|replace|g, caddy always replaces every match
+func convertRewriteResponseHeaders(directive *directiveData) error {
+	rewriteHeaders := directive.children["rewrite_response_headers"]
+	if rewriteHeaders == nil {
+		return nil
+	}
+	delete(directive.children, "rewrite_response_headers")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "rewrite_response_headers")
+	if err != nil {
+		return err
+	}
+	for _, key := range getSortedKeys(&rewriteHeaders.children) {
+		header := rewriteHeaders.children[key]
+		if len(header.args) < 2 || header.args[0] != 's' {
+			return fmt.Errorf("Invalid rewrite_response_headers.%s %q, expected s|find|replace|g", header.name, header.args)
+		}
+		parts := strings.Split(header.args[2:], header.args[1:2])
+		if len(parts) != 3 || parts[0] == "" || (parts[2] != "" && parts[2] != "g") {
+			return fmt.Errorf("Invalid rewrite_response_headers.%s %q, expected s|find|replace|g", header.name, header.args)
+		}
+		if _, err := regexp.Compile(parts[0]); err != nil {
+			return fmt.Errorf("Invalid rewrite_response_headers.%s %q, %v", header.name, header.args, err)
+		}
+		replace := sedBackReferenceRegex.ReplaceAllString(parts[1], "$${$1}")
+		addChildDirective(proxyDirective, "header_downstream rewrite "+key, "header_downstream",
+			header.name+" "+quoteArg(parts[0])+" "+quoteArg(replace))
+	}
+	return nil
+}
+
+func convertHostAliases(directive *directiveData) error {
+	var aliases []string
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) == "host_alias" {
+			aliases = append(aliases, strings.Fields(directive.children[key].args)...)
+			delete(directive.children, key)
+		}
+	}
+	if len(aliases) == 0 {
+		return nil
+	}
+
+	addresses := aliases
+	if address := getSiteAddress(directive); address != "" {
+		for _, siteAddress := range strings.Split(address, ",") {
+			if _, host, _, _ := splitSiteAddress(strings.TrimSpace(siteAddress)); host == "" {
+				return fmt.Errorf("Cannot add host_alias to %s, it already matches every host", strings.TrimSpace(siteAddress))
+			}
+		}
+		addresses = append([]string{address}, aliases...)
+	}
+
+	if directive.name != "" {
+		directive.name = strings.Join(addresses, ", ")
+	} else {
+		directive.args = strings.Join(addresses, ", ")
+	}
+	return nil
+}
+
+// convertPort makes site addresses listen on the port from the port label,
+// using the http and https schemes for the default ports
+func convertPort(directive *directiveData) error {
+	port := directive.children["port"]
+	if port == nil {
+		return nil
+	}
+	delete(directive.children, "port")
+
+	if err := validateRange("port", port.args, 1, 65535); err != nil {
+		return err
+	}
+
+	defaultSchemes := map[string]string{"80": "http", "443": "https"}
+	addresses := strings.Split(getSiteAddress(directive), ",")
+	for i, address := range addresses {
+		address = strings.TrimSpace(address)
+		scheme, host, addressPort, path := splitSiteAddress(address)
+		if host == "" {
+			// Addresses without a host, like the default site, only get their port replaced
+			addresses[i] = ":" + port.args + path
+			continue
+		}
+		if addressPort != "" && addressPort != port.args {
+			return fmt.Errorf("Cannot set port %s on address %q, it already has port %s", port.args, address, addressPort)
+		}
+		defaultScheme := defaultSchemes[port.args]
+		if scheme != "" && defaultScheme != "" && scheme != defaultScheme {
+			return fmt.Errorf("Cannot set port %s on address %q, it uses the %s scheme", port.args, address, scheme)
+		}
+		switch {
+		case defaultScheme != "":
+			addresses[i] = defaultScheme + "://" + host + path
+		case scheme != "":
+			addresses[i] = scheme + "://" + host + ":" + port.args + path
+		default:
+			addresses[i] = host + ":" + port.args + path
+		}
+	}
+
+	if directive.name != "" {
+		directive.name = strings.Join(addresses, ", ")
+	} else {
+		directive.args = strings.Join(addresses, ", ")
+	}
+	return nil
+}
+
+// splitSiteAddress splits a site address in the scheme://host:port/path parts it has
+func splitSiteAddress(address string) (scheme string, host string, port string, path string) {
+	host = address
+	if index := strings.Index(host, "://"); index >= 0 {
+		scheme, host = host[:index], host[index+3:]
+	}
+	if index := strings.Index(host, "/"); index >= 0 {
+		host, path = host[:index], host[index:]
+	}
+	if index := strings.LastIndex(host, ":"); index >= 0 && !strings.HasSuffix(host, "]") {
+		host, port = host[:index], host[index+1:]
+	}
+	return scheme, host, port, path
+}
+
+func convertAcmeIssuer(directive *directiveData) {
+	acmeIssuer := directive.children["acme_issuer"]
+	if acmeIssuer == nil {
+		return
+	}
+	delete(directive.children, "acme_issuer")
+
+	tlsDirective := getOrCreateDirective(directive, "tls")
+	if acmeIssuer.args == "internal" {
+		tlsDirective.args = "self_signed"
+		return
+	}
+	if email := acmeIssuer.children["email"]; email != nil {
+		tlsDirective.args = email.args
+	}
+	if acmeIssuer.args != "" {
+		getOrCreateDirective(tlsDirective, "ca").args = acmeIssuer.args
+	}
+}
+
+func convertMaxConnections(directive *directiveData) error {
+	maxConnections := directive.children["max_connections"]
+	if maxConnections == nil {
+		return nil
+	}
+	delete(directive.children, "max_connections")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "max_connections")
+	if err != nil {
+		return err
+	}
+	if maxConnections.args != "" {
+		getOrCreateDirective(proxyDirective, "max_conns").args = maxConnections.args
+	}
+	if retries := maxConnections.children["retries"]; retries != nil {
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("max_connections.retries %s ignored, caddy proxy doesn't support a retry count, use proxy.try_duration instead", retries.args))
+	}
+	return nil
+}
+
+func convertKeepalive(directive *directiveData) error {
+	keepalive := directive.children["keepalive"]
+	if keepalive == nil {
+		return nil
+	}
+	delete(directive.children, "keepalive")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "keepalive")
+	if err != nil {
+		return err
+	}
+	if off := keepalive.children["off"]; off != nil && isTrue.MatchString(off.args) {
+		getOrCreateDirective(proxyDirective, "keepalive").args = "0"
+	} else if poolSize := keepalive.children["pool_size"]; poolSize != nil {
+		getOrCreateDirective(proxyDirective, "keepalive").args = poolSize.args
+	}
+	if maxIdle := keepalive.children["max_idle"]; maxIdle != nil {
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("keepalive.max_idle %s ignored, caddy proxy doesn't support configuring keepalive idle time", maxIdle.args))
+	}
+	return nil
+}
+
+// normalizeLabelAliases renames alias labels to the labels they stand for,
+// labels using the original names take precedence
+func normalizeLabelAliases(directive *directiveData) {
+	for alias, name := range labelAliases {
+		aliased := directive.children[alias]
+		if aliased == nil {
+			continue
+		}
+		delete(directive.children, alias)
+		if directive.children[name] == nil {
+			aliased.name = name
+			directive.children[name] = aliased
+		}
+	}
+}
+
+// convertHealthCheck checks upstream health by requesting a path periodically
+func convertHealthCheck(directive *directiveData) error {
+	healthCheckPath := directive.children["healthcheck_path"]
+	healthCheckInterval := directive.children["healthcheck_interval"]
+	healthCheckTimeout := directive.children["healthcheck_timeout"]
+	healthCheckExpectStatus := directive.children["healthcheck_expect_status"]
+	delete(directive.children, "healthcheck_path")
+	delete(directive.children, "healthcheck_interval")
+	delete(directive.children, "healthcheck_timeout")
+	delete(directive.children, "healthcheck_expect_status")
+	if healthCheckPath == nil {
+		if healthCheckInterval != nil || healthCheckTimeout != nil || healthCheckExpectStatus != nil {
+			return errors.New("Cannot configure health checks without healthcheck_path")
+		}
+		return nil
+	}
+
+	proxyDirective, err := getTargetProxyDirective(directive, "health checks")
+	if err != nil {
+		return err
+	}
+	getOrCreateDirective(proxyDirective, "health_check").args = healthCheckPath.args
+	if healthCheckInterval != nil {
+		if err := validateDuration("healthcheck_interval", healthCheckInterval.args); err != nil {
+			return err
+		}
+		getOrCreateDirective(proxyDirective, "health_check_interval").args = healthCheckInterval.args
+	}
+	if healthCheckTimeout != nil {
+		if err := validateDuration("healthcheck_timeout", healthCheckTimeout.args); err != nil {
+			return err
+		}
+		getOrCreateDirective(proxyDirective, "health_check_timeout").args = healthCheckTimeout.args
+	}
+	if healthCheckExpectStatus != nil {
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("healthcheck_expect_status %s ignored, caddy proxy health checks accept any 2xx or 3xx status", healthCheckExpectStatus.args))
+	}
+	return nil
+}
+
+// convertUpstreamIdleTimeout limits idle upstream connections kept per host
+func convertUpstreamIdleTimeout(directive *directiveData) error {
+	upstreamIdleTimeout := directive.children["upstream_idle_timeout"]
+	if upstreamIdleTimeout == nil {
+		return nil
+	}
+	delete(directive.children, "upstream_idle_timeout")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "upstream_idle_timeout")
+	if err != nil {
+		return err
+	}
+	if upstreamIdleTimeout.args != "" {
+		if idleConns, err := strconv.Atoi(upstreamIdleTimeout.args); err != nil || idleConns < 0 {
+			return fmt.Errorf("Invalid upstream_idle_timeout %q, expected a number of idle connections", upstreamIdleTimeout.args)
+		}
+		if proxyDirective.children["keepalive"] != nil {
+			return errors.New("Cannot combine upstream_idle_timeout with another label setting the proxy keepalive")
+		}
+		getOrCreateDirective(proxyDirective, "keepalive").args = upstreamIdleTimeout.args
+	}
+	if duration := upstreamIdleTimeout.children["duration"]; duration != nil {
+		if err := validateDuration("upstream_idle_timeout.duration", duration.args); err != nil {
+			return err
+		}
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("upstream_idle_timeout.duration %s ignored, caddy proxy doesn't support configuring keepalive idle time", duration.args))
+	}
+	return nil
+}
+
+// convertUpstreamKeepaliveCount sets the size of the idle upstream connections pool per host
+func convertUpstreamKeepaliveCount(directive *directiveData) error {
+	keepaliveCount := directive.children["upstream_keepalive_count"]
+	keepaliveInterval := directive.children["upstream_keepalive_interval"]
+	if keepaliveCount == nil && keepaliveInterval == nil {
+		return nil
+	}
+	delete(directive.children, "upstream_keepalive_count")
+	delete(directive.children, "upstream_keepalive_interval")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "upstream_keepalive_count")
+	if err != nil {
+		return err
+	}
+	if keepaliveCount != nil {
+		if idleConns, err := strconv.Atoi(keepaliveCount.args); err != nil || idleConns < 0 {
+			return fmt.Errorf("Invalid upstream_keepalive_count %q, expected a number of idle connections", keepaliveCount.args)
+		}
+		if proxyDirective.children["keepalive"] != nil {
+			return errors.New("Cannot combine upstream_keepalive_count with another label setting the proxy keepalive")
+		}
+		getOrCreateDirective(proxyDirective, "keepalive").args = keepaliveCount.args
+	}
+	if keepaliveInterval != nil {
+		if err := validateDuration("upstream_keepalive_interval", keepaliveInterval.args); err != nil {
+			return err
+		}
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("upstream_keepalive_interval %s ignored, caddy proxy doesn't support configuring the connection pool cleanup", keepaliveInterval.args))
+	}
+	return nil
+}
+
+func convertAccessLogFormat(directive *directiveData) {
+	accessLogFormat := directive.children["access_log_format"]
+	if accessLogFormat == nil {
+		return
+	}
+	delete(directive.children, "access_log_format")
+
+	var format string
+	switch accessLogFormat.args {
+	case "common", "combined":
+		format = "{" + accessLogFormat.args + "}"
+	case "json":
+		fields := defaultJSONLogFields
+		if fieldsDirective := accessLogFormat.children["fields"]; fieldsDirective != nil {
+			fields = strings.Fields(fieldsDirective.args)
+		}
+		var entries []string
+		for _, field := range fields {
+			entries = append(entries, fmt.Sprintf(`"%s":"{%s}"`, field, field))
+		}
+		// Literal braces are escaped, otherwise caddy reads the whole object as a placeholder
+		format = `\{` + strings.Join(entries, ",") + `\}`
+	default:
+		format = accessLogFormat.args
+	}
+
+	getOrCreateDirective(directive, "log").args = "/ stdout " + quoteArg(format)
+}
+
+// convertLogRequestBody appends the request body to the access log format, caddy logs
+// up to 100KB of JSON and form request bodies only
+func convertLogRequestBody(directive *directiveData) {
+	logRequestBody := directive.children["log_request_body"]
+	if logRequestBody == nil {
+		return
+	}
+	delete(directive.children, "log_request_body")
+
+	if !isTrue.MatchString(logRequestBody.args) {
+		return
+	}
+
+	logDirective := getOrCreateDirective(directive, "log")
+	switch {
+	case logDirective.args == "":
+		logDirective.args = "/ stdout " + quoteArg("{common} {request_body}")
+	case strings.HasPrefix(logDirective.args, `/ stdout "\{\"`) && strings.HasSuffix(logDirective.args, `\}"`):
+		logDirective.args = strings.TrimSuffix(logDirective.args, `\}"`) + `,\"request_body\":\"{request_body}\"\}"`
+	case strings.HasPrefix(logDirective.args, `/ stdout "`) && strings.HasSuffix(logDirective.args, `"`):
+		logDirective.args = strings.TrimSuffix(logDirective.args, `"`) + ` {request_body}"`
+	default:
+		logDirective.comments = append(logDirective.comments, "log_request_body ignored, log label already sets the format")
+		return
+	}
+	logDirective.comments = append(logDirective.comments,
+		"WARNING: request bodies are logged and may expose passwords, tokens and personal data, use log_request_body only for debugging")
+
+	if maxBytes := logRequestBody.children["max_bytes"]; maxBytes != nil {
+		logDirective.comments = append(logDirective.comments,
+			fmt.Sprintf("log_request_body.max_bytes %s ignored, caddy logs up to 100KB of request bodies", maxBytes.args))
+	}
+	if contentType := logRequestBody.children["content_type"]; contentType != nil &&
+		contentType.args != "application/json" && contentType.args != "application/x-www-form-urlencoded" {
+		logDirective.comments = append(logDirective.comments,
+			fmt.Sprintf("log_request_body.content_type %s ignored, caddy only logs JSON and form request bodies", contentType.args))
+	}
+}
+
+// convertLogToFile writes the access log to a file instead of stdout,
+// keeping the format from access_log_format
+func convertLogToFile(directive *directiveData) error {
+	logToFile := directive.children["log_to_file"]
+	if logToFile == nil {
+		return nil
+	}
+	delete(directive.children, "log_to_file")
+
+	logDirective := getOrCreateDirective(directive, "log")
+	switch {
+	case logDirective.args == "":
+		logDirective.args = "/ " + logToFile.args
+	case strings.HasPrefix(logDirective.args, "/ stdout"):
+		logDirective.args = "/ " + logToFile.args + strings.TrimPrefix(logDirective.args, "/ stdout")
+	default:
+		logDirective.comments = append(logDirective.comments, "log_to_file ignored, log label already sets the output")
+		return nil
+	}
+	logDirective.comments = append(logDirective.comments,
+		fmt.Sprintf("directory of %s must exist, caddy doesn't create it", logToFile.args))
+
+	if rollSize := logToFile.children["roll_size"]; rollSize != nil {
+		size := strings.TrimSuffix(strings.ToUpper(rollSize.args), "MB")
+		if _, err := strconv.Atoi(size); err != nil {
+			return fmt.Errorf("Invalid log_to_file.roll_size %q, expected a size in megabytes like 100MB", rollSize.args)
+		}
+		getOrCreateDirective(logDirective, "rotate_size").args = size
+	}
+	return nil
+}
+
+// convertLogSkipPaths excludes paths from the access log, logging to stdout
+// when no other log label is defined
+func convertLogSkipPaths(directive *directiveData) {
+	logSkipPaths := directive.children["log_skip_paths"]
+	if logSkipPaths == nil {
+		return
+	}
+	delete(directive.children, "log_skip_paths")
+
+	paths := strings.Fields(logSkipPaths.args)
+	if len(paths) == 0 {
+		return
+	}
+
+	logDirective := getOrCreateDirective(directive, "log")
+	if logDirective.args == "" {
+		logDirective.args = "/ stdout"
+	}
+	getOrCreateDirective(logDirective, "except").args = strings.Join(paths, " ")
+}
+
+func convertPush(directive *directiveData) {
+	push := directive.children["push"]
+	if push == nil || push.children != nil {
+		return
+	}
+
+	push.args = strings.TrimSpace("/ " + push.args)
+	push.comments = append(push.comments, "HTTP/2 push is removed in caddy v2, replace it with 103 Early Hints when migrating")
+}
+
+// convertStaticFileServer serves files from a folder of caddy host instead of proxying to the target
+func convertStaticFileServer(directive *directiveData, staticFileServer *directiveData) error {
+	delete(directive.children, "static_file_server")
+	if staticFileServer.args == "" {
+		return fmt.Errorf("Invalid static_file_server %q, expected a folder path", staticFileServer.args)
+	}
+
+	getOrCreateDirective(directive, "root").args = staticFileServer.args
+	if directive.children["targetport"] != nil || directive.children["targetprotocol"] != nil {
+		directive.comments = append(directive.comments, "targetport ignored, static_file_server serves files without proxy")
+	}
+	return nil
+}
+
+// convertCORSPreflightMaxAge sets how long browsers cache preflight responses
+// with max_age of the http.cors plugin, which answers OPTIONS requests itself
+func convertCORSPreflightMaxAge(directive *directiveData) {
+	cors := directive.children["cors"]
+	if cors == nil {
+		return
+	}
+	preflightMaxAge := cors.children["preflight_max_age"]
+	if preflightMaxAge == nil {
+		return
+	}
+	delete(cors.children, "preflight_max_age")
+
+	getOrCreateDirective(cors, "max_age").args = preflightMaxAge.args
+}
+
+func convertBrowse(directive *directiveData) {
+	browse := directive.children["browse"]
+	if browse == nil || !isTrue.MatchString(browse.args) {
+		return
+	}
+
+	browse.args = "/"
+	if template := browse.children["template"]; template != nil {
+		browse.args += " " + template.args
+	}
+	browse.children = nil
+	if directive.children["root"] == nil {
+		browse.comments = append(browse.comments, "browse implies serving static files from the site root, set caddy.root to choose the folder")
+	}
+}
+
+func convertTLSInsecureSkipVerify(directive *directiveData, targetName string) {
+	skipVerify := directive.children["tls_insecure_skip_verify"]
+	if skipVerify == nil {
+		return
+	}
+	delete(directive.children, "tls_insecure_skip_verify")
+
+	if !isTrue.MatchString(skipVerify.args) {
+		return
+	}
+	proxyDirective := directive.children["proxy"]
+	if proxyDirective == nil || !strings.Contains(proxyDirective.args, "https://") {
+		directive.comments = append(directive.comments, "tls_insecure_skip_verify ignored, it requires targetprotocol https")
+		return
+	}
+
+	getOrCreateDirective(proxyDirective, "insecure_skip_verify")
+	proxyDirective.comments = append(proxyDirective.comments,
+		fmt.Sprintf("WARNING: TLS verification of %s is disabled, provide its CA certificate with caddy.proxy.ca_certificates instead", targetName))
+}
+
+func convertWebsocket(directive *directiveData) error {
+	websocket := directive.children["websocket"]
+	if websocket != nil && isTrue.MatchString(websocket.args) {
+		delete(directive.children, "websocket")
+		proxyDirective, err := getTargetProxyDirective(directive, "websocket")
+		if err != nil {
+			return err
+		}
+		getOrCreateDirective(proxyDirective, "websocket")
+		if idleConnTimeout := websocket.children["idle_conn_timeout"]; idleConnTimeout != nil {
+			if err := validateDuration("websocket.idle_conn_timeout", idleConnTimeout.args); err != nil {
+				return err
+			}
+			proxyDirective.comments = append(proxyDirective.comments,
+				fmt.Sprintf("websocket.idle_conn_timeout %s ignored, caddy proxy doesn't support upstream idle timeouts", idleConnTimeout.args))
+		}
+	}
+
+	if timeout := directive.children["websocket_timeout"]; timeout != nil {
+		delete(directive.children, "websocket_timeout")
+		if err := validateDuration("websocket_timeout", timeout.args); err != nil {
+			return err
+		}
+		directive.comments = append(directive.comments,
+			fmt.Sprintf("websocket_timeout %s ignored, caddy proxy timeout only limits connecting to the upstream, websockets have no idle timeout", timeout.args))
+	}
+
+	if pingInterval := directive.children["websocket_ping_interval"]; pingInterval != nil {
+		delete(directive.children, "websocket_ping_interval")
+		if err := validateDuration("websocket_ping_interval", pingInterval.args); err != nil {
+			return err
+		}
+		proxyDirective, err := getTargetProxyDirective(directive, "websocket_ping_interval")
+		if err != nil {
+			return err
+		}
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("websocket_ping_interval %s ignored, caddy proxy doesn't send websocket pings", pingInterval.args))
+	}
+	return nil
+}
+
+func convertTrace(directive *directiveData) error {
+	trace := directive.children["trace"]
+	if trace == nil {
+		return nil
+	}
+	delete(directive.children, "trace")
+
+	var headers []string
+	if trace.args == "passthrough" {
+		for _, protocolHeaders := range traceHeaders {
+			headers = append(headers, protocolHeaders...)
+		}
+	} else if protocolHeaders, ok := traceHeaders[trace.args]; ok {
+		headers = protocolHeaders
+	} else {
+		return fmt.Errorf("Invalid trace %q, expected b3, w3c, jaeger or passthrough", trace.args)
+	}
+
+	proxyDirective, err := getTargetProxyDirective(directive, "trace")
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		addChildDirective(proxyDirective, "header_upstream "+header, "header_upstream", fmt.Sprintf("%s {>%s}", header, header))
+	}
+	return nil
+}
+
+func convertCompressTypes(directive *directiveData) {
+	compressTypes := directive.children["compress_types"]
+	if compressTypes == nil {
+		return
+	}
+	delete(directive.children, "compress_types")
+
+	gzipDirective := getOrCreateDirective(directive, "gzip")
+	if minSize := compressTypes.children["compress_min_size"]; minSize != nil {
+		getOrCreateDirective(gzipDirective, "min_length").args = minSize.args
+	}
+	gzipDirective.comments = append(gzipDirective.comments,
+		fmt.Sprintf("compress_types %s ignored, caddy gzip can't filter by content type, use caddy.gzip.ext instead", compressTypes.args))
+}
+
+func convertDNS(directive *directiveData) {
+	dns := directive.children["dns"]
+	if dns == nil {
+		return
+	}
+	delete(directive.children, "dns")
+
+	provider := dns.args
+	if providerDirective := dns.children["provider"]; providerDirective != nil {
+		provider = providerDirective.args
+	}
+
+	dnsDirective := getOrCreateDirective(directive, "tls.dns")
+	dnsDirective.args = provider
+	if !knownDNSProviders[provider] {
+		dnsDirective.comments = append(dnsDirective.comments, fmt.Sprintf("WARNING: unknown dns provider %s", provider))
+	}
+	if envToken := dns.children["env_token"]; envToken != nil {
+		dnsDirective.comments = append(dnsDirective.comments,
+			fmt.Sprintf("dns.env_token %s ignored, dns providers read credentials from their own environment variables", envToken.args))
+	}
+}
+
+func convertClientCert(directive *directiveData) error {
+	clientCert := directive.children["client_cert"]
+	clientCertCA := directive.children["client_cert_ca"]
+	if clientCert == nil && clientCertCA == nil {
+		return nil
+	}
+	delete(directive.children, "client_cert")
+	delete(directive.children, "client_cert_ca")
+
+	if clientCert != nil && !isTrue.MatchString(clientCert.args) && clientCert.children == nil {
+		return nil
+	}
+
+	var args []string
+	verify := true
+	if clientCert != nil {
+		if mode := clientCert.children["mode"]; mode != nil {
+			switch mode.args {
+			case "request", "require":
+				args = append(args, mode.args)
+				verify = false
+			case "verify_if_given":
+				args = append(args, mode.args)
+			case "require_and_verify":
+			default:
+				return fmt.Errorf("Invalid client_cert.mode %q, expected request, require, verify_if_given or require_and_verify", mode.args)
+			}
+		}
+	}
+	if clientCertCA != nil {
+		args = append(args, strings.Fields(clientCertCA.args)...)
+	}
+	if verify && (clientCertCA == nil || clientCertCA.args == "") {
+		return errors.New("client_cert requires client_cert_ca to verify clients, unless client_cert.mode is request or require")
+	}
+
+	getOrCreateDirective(directive, "tls.clients").args = strings.Join(args, " ")
+	return nil
+}
+
+func convertTimeout(directive *directiveData) error {
+	timeout := directive.children["timeout"]
+	if timeout == nil {
+		return nil
+	}
+	upstreamResponse := timeout.children["upstream_response"]
+	gracefulShutdown := timeout.children["graceful_shutdown"]
+	if upstreamResponse == nil && gracefulShutdown == nil {
+		return nil
+	}
+	delete(timeout.children, "upstream_response")
+	delete(timeout.children, "graceful_shutdown")
+	if len(timeout.children) == 0 {
+		timeout.children = nil
+		if timeout.args == "" {
+			delete(directive.children, "timeout")
+		}
+	}
+
+	if upstreamResponse != nil {
+		if err := validateDuration("timeout.upstream_response", upstreamResponse.args); err != nil {
+			return err
+		}
+		// caddy has no upstream response timeout, the write timeout is shared by every
+		// site of the listener and a limit would cut long-polling responses
+		if duration, _ := time.ParseDuration(upstreamResponse.args); duration == 0 {
+			getOrCreateDirective(directive, "timeouts.write").args = "0"
+		} else {
+			directive.comments = append(directive.comments, fmt.Sprintf(
+				"timeout.upstream_response %s ignored, caddy can't limit upstream responses, only 0 is supported to disable the write timeout", upstreamResponse.args))
+		}
+	}
+	if gracefulShutdown != nil {
+		if err := validateDuration("timeout.graceful_shutdown", gracefulShutdown.args); err != nil {
+			return err
+		}
+		directive.comments = append(directive.comments, fmt.Sprintf(
+			"timeout.graceful_shutdown %s ignored, caddy grace period applies to all sites, start caddy with -grace %s", gracefulShutdown.args, gracefulShutdown.args))
+	}
+	return nil
+}
+
+var tlsVersions = []string{"1.0", "1.1", "1.2", "1.3"}
+
+func convertTLSVersions(directive *directiveData) error {
+	minVersion := directive.children["tls_min_version"]
+	maxVersion := directive.children["tls_max_version"]
+	if minVersion == nil && maxVersion == nil {
+		return nil
+	}
+	delete(directive.children, "tls_min_version")
+	delete(directive.children, "tls_max_version")
+
+	minIndex, maxIndex := 0, len(tlsVersions)-1
+	if minVersion != nil {
+		minIndex = indexOf(tlsVersions, minVersion.args)
+		if minIndex < 0 {
+			return fmt.Errorf("Invalid tls_min_version %q, expected one of %s", minVersion.args, strings.Join(tlsVersions, ", "))
+		}
+	}
+	if maxVersion != nil {
+		maxIndex = indexOf(tlsVersions, maxVersion.args)
+		if maxIndex < 0 {
+			return fmt.Errorf("Invalid tls_max_version %q, expected one of %s", maxVersion.args, strings.Join(tlsVersions, ", "))
+		}
+	}
+	if minIndex > maxIndex {
+		return fmt.Errorf("Invalid tls versions, tls_min_version %s is greater than tls_max_version %s", tlsVersions[minIndex], tlsVersions[maxIndex])
+	}
+
+	getOrCreateDirective(directive, "tls.protocols").args = fmt.Sprintf("tls%s tls%s", tlsVersions[minIndex], tlsVersions[maxIndex])
+	return nil
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func convertRedirectScheme(directive *directiveData) error {
+	redirectScheme := directive.children["redirect_scheme"]
+	if redirectScheme == nil {
+		return nil
+	}
+	delete(directive.children, "redirect_scheme")
+
+	var fromScheme string
+	switch redirectScheme.args {
+	case "https":
+		fromScheme = "http"
+	case "http":
+		fromScheme = "https"
+	default:
+		return fmt.Errorf("Invalid redirect_scheme %q, expected http or https", redirectScheme.args)
+	}
+
+	if strings.Contains(getSiteAddress(directive), redirectScheme.args+"://") {
+		directive.comments = append(directive.comments,
+			fmt.Sprintf("redirect_scheme %s ignored, site address already uses %s", redirectScheme.args, redirectScheme.args))
+		return nil
+	}
+
+	redirDirective := addChildDirective(directive, "redir redirect_scheme", "redir", "301")
+	addChildDirective(redirDirective, "if", "if", "{scheme} is "+fromScheme)
+	addChildDirective(redirDirective, "/", "/", redirectScheme.args+"://{host}{uri}")
+	return nil
+}
+
+// convertRedirectTrailingSlash redirects paths without trailing slash to the
+// path with it, or rewrites paths with trailing slash to the path without it,
+// because redir can't remove part of the path
+func convertRedirectTrailingSlash(directive *directiveData) error {
+	redirectTrailingSlash := directive.children["redirect_trailing_slash"]
+	if redirectTrailingSlash == nil {
+		return nil
+	}
+	delete(directive.children, "redirect_trailing_slash")
+
+	switch redirectTrailingSlash.args {
+	case "off":
+	case "add":
+		redirDirective := addChildDirective(directive, "redir redirect_trailing_slash", "redir", "301")
+		addChildDirective(redirDirective, "if", "if", "{path} not_ends_with /")
+		addChildDirective(redirDirective, "/", "/", "{path}/{?query}")
+	case "remove":
+		rewriteDirective, err := addRewriteDirective(directive, "redirect_trailing_slash", "")
+		if err != nil {
+			return err
+		}
+		rewriteDirective.comments = append(rewriteDirective.comments,
+			"redirect_trailing_slash remove rewrites paths instead of redirecting, caddy redir can't remove the trailing slash")
+		addChildDirective(rewriteDirective, "regex", "regex", "^(.+)/$")
+		addChildDirective(rewriteDirective, "to", "to", "{1}")
+	default:
+		return fmt.Errorf("Invalid redirect_trailing_slash %q, expected add, remove or off", redirectTrailingSlash.args)
+	}
+	return nil
+}
+
+// convertAutoHTTPS disables automatic https for the site with tls off
+func convertAutoHTTPS(directive *directiveData) error {
+	autoHTTPS := directive.children["auto_https"]
+	if autoHTTPS == nil {
+		return nil
+	}
+	delete(directive.children, "auto_https")
+
+	switch autoHTTPS.args {
+	case "on":
+		return nil
+	case "off":
+		tls := getOrCreateDirective(directive, "tls")
+		if tls.children != nil || (tls.args != "" && tls.args != "off") {
+			return errors.New("Cannot combine auto_https off with tls labels")
+		}
+		tls.args = "off"
+	case "disable_redirects":
+		directive.comments = append(directive.comments,
+			"auto_https disable_redirects ignored, caddy can't disable the http to https redirect of a single site")
+	default:
+		return fmt.Errorf("Invalid auto_https %q, expected on, off or disable_redirects", autoHTTPS.args)
+	}
+	return nil
+}
+
+func convertDenyPaths(directive *directiveData) {
+	var paths []string
+	var response *directiveData
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) != "deny_path" {
+			continue
+		}
+		denyPath := directive.children[key]
+		delete(directive.children, key)
+
+		paths = append(paths, strings.Fields(denyPath.args)...)
+		if r := denyPath.children["response"]; r != nil {
+			response = r
+		}
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	statusDirective := addChildDirective(directive, "status deny_path", "status", "403")
+	for _, path := range paths {
+		addChildDirective(statusDirective, path, path, "")
+	}
+	if response != nil {
+		statusDirective.comments = append(statusDirective.comments,
+			fmt.Sprintf("deny_path.response %s ignored, use caddy.errors to customize the 403 page", response.args))
+	}
+}
+
+const notAllowedPath = "/caddy-docker-proxy-not-allowed"
+
+// convertAllowPaths responds 404 to paths not allowed by rewriting them to a path handled by status,
+// denied paths are kept so deny_path still responds 403
+func convertAllowPaths(directive *directiveData) error {
+	var paths []string
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) == "allow_path" {
+			for _, path := range strings.Fields(directive.children[key].args) {
+				paths = append(paths, strings.TrimSuffix(path, "*"))
+			}
+			delete(directive.children, key)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	if denyStatus := directive.children["status deny_path"]; denyStatus != nil {
+		paths = append(paths, getSortedKeys(&denyStatus.children)...)
+	}
+
+	rewriteDirective, err := addRewriteDirective(directive, "allow_path", "")
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		addChildDirective(rewriteDirective, "if "+path, "if", "{path} not_starts_with "+path)
+	}
+	addChildDirective(rewriteDirective, "if_op", "if_op", "and")
+	addChildDirective(rewriteDirective, "to", "to", notAllowedPath)
+	addChildDirective(directive, "status allow_path", "status", "404 "+notAllowedPath)
+	return nil
+}
+
+// convertPathMatcher responds 404 to paths not matching a regular expression, the same way
+// allow_path does, because caddy proxy can only match path prefixes
+func convertPathMatcher(directive *directiveData) error {
+	pathMatcher := directive.children["path_matcher"]
+	if pathMatcher == nil {
+		return nil
+	}
+	delete(directive.children, "path_matcher")
+
+	fields := strings.Fields(pathMatcher.args)
+	if len(fields) != 2 || fields[0] != "path_regexp" {
+		return fmt.Errorf("Invalid path_matcher %q, expected path_regexp <regexp>", pathMatcher.args)
+	}
+	if _, err := regexp.Compile(fields[1]); err != nil {
+		return fmt.Errorf("Invalid path_matcher %q, %v", pathMatcher.args, err)
+	}
+
+	rewriteDirective, err := addRewriteDirective(directive, "path_matcher", "")
+	if err != nil {
+		return err
+	}
+	addChildDirective(rewriteDirective, "if", "if", "{path} not_match "+quoteArg(fields[1]))
+	addChildDirective(rewriteDirective, "to", "to", notAllowedPath)
+	addChildDirective(directive, "status path_matcher", "status", "404 "+notAllowedPath)
+	return nil
+}
+
+// findRewrite returns the key of the first rewrite directive of the site, caddy only
+// applies the rewrite with the longest matching base path, so access rules generated
+// with rewrites can't be combined with other rewrites
+func findRewrite(directive *directiveData) string {
+	for _, key := range getSortedKeys(&directive.children) {
+		if directive.children[key].name == "rewrite" {
+			return key
+		}
+	}
+	return ""
+}
+
+// addRewriteDirective adds the rewrite generated by a label, failing when the site
+// already has a rewrite that would make caddy skip one of them
+func addRewriteDirective(directive *directiveData, label string, args string) (*directiveData, error) {
+	if key := findRewrite(directive); key != "" {
+		return nil, fmt.Errorf("Cannot combine %s with %s, caddy applies a single rewrite per request", label, getRewriteLabel(key))
+	}
+	return addChildDirective(directive, "rewrite "+label, "rewrite", args), nil
+}
+
+// getRewriteLabel returns the label that generated a rewrite directive key
+func getRewriteLabel(key string) string {
+	if index := strings.Index(key, " "); index >= 0 {
+		return key[index+1:]
+	}
+	return removeSuffix(key)
+}
+
+var rateRegex = regexp.MustCompile(`^(\d+)r/(s|m|h|d)$`)
+
+var rateUnits = map[string]string{"s": "second", "m": "minute", "h": "hour", "d": "day"}
+
+// convertRateLimit limits requests with the http.ratelimit plugin, by client
+// IP or by the value of a request header
+func convertRateLimit(directive *directiveData) error {
+	rateLimit := directive.children["rate_limit"]
+	if rateLimit == nil {
+		return nil
+	}
+	delete(directive.children, "rate_limit")
+
+	if !isPluginInstalled("http.ratelimit") {
+		directive.comments = append(directive.comments, "rate_limit ignored, install the http.ratelimit plugin to enable rate limiting")
+		return nil
+	}
+
+	rateLimitDirective := getOrCreateDirective(directive, "ratelimit")
+	rateLimitDirective.args = rateLimit.args
+	if rate := rateLimit.children["rate"]; rate != nil {
+		args, err := getRateLimitArgs(rateLimit.args, rate, rateLimit.children["burst"])
+		if err != nil {
+			return err
+		}
+		rateLimitDirective.args = args
+	}
+	if byHeader := rateLimit.children["by_header"]; byHeader != nil {
+		getOrCreateDirective(rateLimitDirective, "limit_by_header").args = byHeader.args
+	}
+	if fallback := rateLimit.children["fallback"]; fallback != nil {
+		rateLimitDirective.comments = append(rateLimitDirective.comments,
+			fmt.Sprintf("rate_limit.fallback %s ignored, requests without the header share the same limit", fallback.args))
+	}
+	return nil
+}
+
+// getRateLimitArgs converts rate labels like 100r/s to ratelimit path, rate,
+// burst and unit arguments, bursting to twice the rate by default
+func getRateLimitArgs(path string, rate *directiveData, burst *directiveData) (string, error) {
+	match := rateRegex.FindStringSubmatch(rate.args)
+	if match == nil {
+		return "", fmt.Errorf("Invalid rate_limit.rate %q, expected a rate like 100r/s", rate.args)
+	}
+	requests, _ := strconv.Atoi(match[1])
+
+	burstRequests := requests * 2
+	if burst != nil {
+		var err error
+		if burstRequests, err = strconv.Atoi(burst.args); err != nil || burstRequests < requests {
+			return "", fmt.Errorf("Invalid rate_limit.burst %q, expected a number of requests not less than the rate", burst.args)
+		}
+	}
+
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s %d %d %s", path, requests, burstRequests, rateUnits[match[2]]), nil
+}
+
+// convertRequestRate limits all requests of the site by client IP, a shorthand for rate_limit.rate
+func convertRequestRate(directive *directiveData) error {
+	requestRate := directive.children["request_rate"]
+	if requestRate == nil {
+		return nil
+	}
+	delete(directive.children, "request_rate")
+
+	if !rateRegex.MatchString(requestRate.args) {
+		return fmt.Errorf("Invalid request_rate %q, expected a rate like 50r/m", requestRate.args)
+	}
+	if !isPluginInstalled("http.ratelimit") {
+		directive.comments = append(directive.comments, "request_rate ignored, install the http.ratelimit plugin to enable rate limiting")
+		return nil
+	}
+	if directive.children["ratelimit"] != nil {
+		return errors.New("Cannot combine request_rate with rate_limit labels")
+	}
+
+	args, err := getRateLimitArgs("/", requestRate, nil)
+	if err != nil {
+		return err
+	}
+	getOrCreateDirective(directive, "ratelimit").args = args
+	return nil
+}
+
+// convertMetricsPath serves caddy prometheus metrics at a path of the site
+func convertMetricsPath(directive *directiveData) {
+	metricsPath := directive.children["metrics_path"]
+	if metricsPath == nil {
+		return
+	}
+	delete(directive.children, "metrics_path")
+
+	if !isPluginInstalled("http.prometheus") {
+		directive.comments = append(directive.comments, "metrics_path ignored, install the http.prometheus plugin to expose metrics")
+		return
+	}
+
+	prometheusDirective := getOrCreateDirective(directive, "prometheus")
+	getOrCreateDirective(prometheusDirective, "use_caddy_addr")
+	getOrCreateDirective(prometheusDirective, "path").args = metricsPath.args
+	if allowIPs := metricsPath.children["allow_ips"]; allowIPs != nil {
+		prometheusDirective.comments = append(prometheusDirective.comments,
+			fmt.Sprintf("metrics_path.allow_ips %s ignored, caddy can't restrict the prometheus endpoint by IP", allowIPs.args))
+	}
+}
+
+// convertMetricsLabels adds labels to caddy metrics of the site, the same label
+// names must be used by every site because caddy registers metrics once
+func convertMetricsLabels(directive *directiveData) {
+	metricsLabels := directive.children["metrics_label"]
+	if metricsLabels == nil {
+		return
+	}
+	delete(directive.children, "metrics_label")
+
+	if !isPluginInstalled("http.prometheus") {
+		directive.comments = append(directive.comments, "metrics_label ignored, install the http.prometheus plugin to expose metrics")
+		return
+	}
+
+	prometheusDirective := getOrCreateDirective(directive, "prometheus")
+	for _, key := range getSortedKeys(&metricsLabels.children) {
+		label := metricsLabels.children[key]
+		addChildDirective(prometheusDirective, "label "+key, "label", label.name+" "+quoteArg(label.args))
+	}
+}
+
+// convertTrustedProxiesCloudflare trusts client IPs forwarded by cloudflare,
+// using the cloudflare ranges of the http.realip plugin
+func convertTrustedProxiesCloudflare(directive *directiveData) {
+	trustedProxiesCloudflare := directive.children["trusted_proxies_cloudflare"]
+	if trustedProxiesCloudflare == nil {
+		return
+	}
+	delete(directive.children, "trusted_proxies_cloudflare")
+
+	if !isTrue.MatchString(trustedProxiesCloudflare.args) {
+		return
+	}
+	if !isPluginInstalled("http.realip") {
+		directive.comments = append(directive.comments, "trusted_proxies_cloudflare ignored, install the http.realip plugin to trust cloudflare")
+		return
+	}
+	getOrCreateDirective(directive, "realip").args = "cloudflare"
+}
+
+const notTrustedPath = "/caddy-docker-proxy-not-trusted"
+
+// convertResponseTransforms replaces text in response bodies with the http.filter plugin,
+// each find and replace pair generating a filter rule
+func convertResponseTransforms(directive *directiveData) error {
+	var transforms []*directiveData
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) == "response_transform" {
+			transforms = append(transforms, directive.children[key])
+			delete(directive.children, key)
+		}
+	}
+	if len(transforms) == 0 {
+		return nil
+	}
+
+	if !isPluginInstalled("http.filter") {
+		directive.comments = append(directive.comments, "response_transform ignored, install the http.filter plugin to transform responses")
+		return nil
+	}
+
+	for i, transform := range transforms {
+		find := transform.children["find"]
+		replace := transform.children["replace"]
+		if find == nil || replace == nil {
+			return errors.New("Invalid response_transform, expected find and replace labels")
+		}
+		filterDirective := addChildDirective(directive, fmt.Sprintf("filter response_transform_%d", i), "filter", "rule")
+		if contentType := transform.children["content_type"]; contentType != nil {
+			addChildDirective(filterDirective, "content_type", "content_type", quoteArg(regexp.QuoteMeta(contentType.args)))
+		} else {
+			addChildDirective(filterDirective, "path", "path", ".*")
+		}
+		addChildDirective(filterDirective, "search_pattern", "search_pattern", quoteArg(regexp.QuoteMeta(find.args)))
+		addChildDirective(filterDirective, "replacement", "replacement", quoteArg(replace.args))
+	}
+	return nil
+}
+
+// privateRemoteRegex matches loopback and private network client IPs
+const privateRemoteRegex = `^(10\.|172\.(1[6-9]|2[0-9]|3[01])\.|192\.168\.|127\.|::1$|f[cd])`
+
+// convertInternal responds 403 to requests not coming from private networks
+func convertInternal(directive *directiveData) error {
+	internal := directive.children["internal"]
+	if internal == nil {
+		return nil
+	}
+	delete(directive.children, "internal")
+
+	if !isTrue.MatchString(internal.args) {
+		return nil
+	}
+	rewriteDirective, err := addRewriteDirective(directive, "internal", "/")
+	if err != nil {
+		return err
+	}
+	addChildDirective(rewriteDirective, "if", "if", "{remote} not_match "+quoteArg(privateRemoteRegex))
+	addChildDirective(rewriteDirective, "to", "to", notTrustedPath)
+	addChildDirective(directive, "status not_trusted", "status", "403 "+notTrustedPath)
+	return nil
+}
+
+// convertPprof proxies pprof debugging endpoints to the target, responding 403
+// to requests not coming from localhost
+func convertPprof(directive *directiveData, getProxyTargets func() ([]string, error)) error {
+	pprof := directive.children["pprof"]
+	if pprof == nil {
+		return nil
+	}
+	delete(directive.children, "pprof")
+
+	if !isTrue.MatchString(pprof.args) {
+		return nil
+	}
+
+	port := "6060"
+	if portDirective := pprof.children["port"]; portDirective != nil {
+		if err := validateRange("pprof.port", portDirective.args, 1, 65535); err != nil {
+			return err
+		}
+		port = portDirective.args
+	}
+
+	proxyTargets, err := getProxyTargets()
+	if err != nil {
+		return err
+	}
+	proxyArgs := "/debug/pprof"
+	for _, proxyTarget := range proxyTargets {
+		proxyArgs += fmt.Sprintf(" %s:%s", proxyTarget, port)
+	}
+	addChildDirective(directive, "proxy pprof", "proxy", proxyArgs)
+
+	rewriteDirective, err := addRewriteDirective(directive, "pprof", "/debug/pprof")
+	if err != nil {
+		return err
+	}
+	addChildDirective(rewriteDirective, "if 127.0.0.1", "if", "{remote} not 127.0.0.1")
+	addChildDirective(rewriteDirective, "if ::1", "if", "{remote} not ::1")
+	addChildDirective(rewriteDirective, "if_op", "if_op", "and")
+	addChildDirective(rewriteDirective, "to", "to", notTrustedPath)
+	addChildDirective(directive, "status not_trusted", "status", "403 "+notTrustedPath)
+	return nil
+}
+
+func convertCache(directive *directiveData) {
+	cache := directive.children["cache"]
+	if cache == nil {
+		return
+	}
+	delete(directive.children, "cache")
+
+	if !isTrue.MatchString(cache.args) && cache.children == nil {
+		return
+	}
+	if !isPluginInstalled("http.cache") {
+		directive.comments = append(directive.comments, "cache ignored, install the http.cache plugin to enable caching")
+		return
+	}
+
+	cacheDirective := getOrCreateDirective(directive, "cache")
+	if ttl := cache.children["ttl"]; ttl != nil {
+		getOrCreateDirective(cacheDirective, "default_max_age").args = ttl.args
+	}
+	if methods := cache.children["methods"]; methods != nil {
+		cacheDirective.comments = append(cacheDirective.comments,
+			fmt.Sprintf("cache.methods %s ignored, the cache plugin only caches GET and HEAD requests", methods.args))
+	}
+}
+
+func convertCircuitBreaker(directive *directiveData) error {
+	circuitBreaker := directive.children["circuit_breaker"]
+	if circuitBreaker == nil {
+		return nil
+	}
+	delete(directive.children, "circuit_breaker")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "circuit_breaker")
+	if err != nil {
+		return err
+	}
+	if threshold := circuitBreaker.children["threshold"]; threshold != nil {
+		if value, err := strconv.ParseFloat(threshold.args, 64); err != nil || value < 0 || value > 1 {
+			return fmt.Errorf("Invalid circuit_breaker.threshold %q, expected a number from 0 to 1", threshold.args)
+		}
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("circuit_breaker.threshold %s ignored, caddy proxy only supports failure counts with proxy.max_fails", threshold.args))
+	}
+	if window := circuitBreaker.children["window"]; window != nil {
+		if err := validateDuration("circuit_breaker.window", window.args); err != nil {
+			return err
+		}
+		getOrCreateDirective(proxyDirective, "fail_timeout").args = window.args
+	}
+	return nil
+}
+
+const defaultTryInterval = 250 * time.Millisecond
+
+// convertRetryPolicy retries failed upstream connections every backoff until attempts are exhausted
+func convertRetryPolicy(directive *directiveData) error {
+	retryPolicy := directive.children["retry_policy"]
+	if retryPolicy == nil {
+		return nil
+	}
+	delete(directive.children, "retry_policy")
+
+	proxyDirective, err := getTargetProxyDirective(directive, "retry_policy")
+	if err != nil {
+		return err
+	}
+
+	backoff := defaultTryInterval
+	if backoffDirective := retryPolicy.children["backoff"]; backoffDirective != nil {
+		if err := validateDuration("retry_policy.backoff", backoffDirective.args); err != nil {
+			return err
+		}
+		backoff, _ = time.ParseDuration(backoffDirective.args)
+		getOrCreateDirective(proxyDirective, "try_interval").args = backoffDirective.args
+	}
+	if attempts := retryPolicy.children["attempts"]; attempts != nil {
+		count, err := strconv.Atoi(attempts.args)
+		if err != nil || count < 0 {
+			return fmt.Errorf("Invalid retry_policy.attempts %q, expected a positive number", attempts.args)
+		}
+		getOrCreateDirective(proxyDirective, "try_duration").args = (time.Duration(count) * backoff).String()
+	}
+	if onStatus := retryPolicy.children["on_status"]; onStatus != nil {
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("retry_policy.on_status %s ignored, caddy proxy only retries failed connections", onStatus.args))
+	}
+	if allowUnsafe := retryPolicy.children["allow_unsafe"]; allowUnsafe != nil {
+		proxyDirective.comments = append(proxyDirective.comments,
+			fmt.Sprintf("retry_policy.allow_unsafe %s ignored, caddy proxy only retries failed connections, which is safe for every method", allowUnsafe.args))
+	}
+	return nil
+}
+
+// convertRedirectFrom creates sites redirecting the hosts in redirect_from labels to the site address
+func convertRedirectFrom(directive *directiveData) map[string]*directiveData {
+	redirectSites := map[string]*directiveData{}
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) != "redirect_from" {
+			continue
+		}
+		redirectFrom := directive.children[key]
+		delete(directive.children, key)
+
+		target := getSiteAddress(directive)
+		if targetDirective := redirectFrom.children["target"]; targetDirective != nil {
+			target = targetDirective.args
+		}
+		targets := strings.Fields(strings.Replace(target, ",", " ", -1))
+		if len(targets) == 0 {
+			directive.comments = append(directive.comments, fmt.Sprintf("%s ignored, site has no address to redirect to", key))
+			continue
+		}
+		target = strings.TrimRight(targets[0], "/")
+		if !strings.Contains(target, "://") {
+			target = "https://" + target
+		}
+
+		redirectSite := &directiveData{name: redirectFrom.args}
+		getOrCreateDirective(redirectSite, "redir").args = target + "{uri} 301"
+		redirectSites[key] = redirectSite
+	}
+	return redirectSites
+}
+
+// convertSubdomainRouting creates one site per subdomain label, proxying to its backend,
+// while the wildcard site keeps proxying other subdomains to the default target
+func convertSubdomainRouting(directive *directiveData) (map[string]*directiveData, error) {
+	subdomainRouting := directive.children["subdomain_routing"]
+	if subdomainRouting == nil {
+		return nil, nil
+	}
+	delete(directive.children, "subdomain_routing")
+
+	if !isTrue.MatchString(subdomainRouting.args) {
+		return nil, nil
+	}
+	address := getSiteAddress(directive)
+	if !strings.HasPrefix(address, "*.") || strings.ContainsAny(address, " ,") {
+		return nil, fmt.Errorf("Invalid subdomain_routing address %q, expected a single wildcard address like *.example.com", address)
+	}
+
+	subdomainSites := map[string]*directiveData{}
+	for subdomain, backend := range subdomainRouting.children {
+		subdomainSite := cloneDirective(directive)
+		subdomainSite.name = subdomain + strings.TrimPrefix(address, "*")
+		subdomainSite.args = ""
+		for key, child := range subdomainSite.children {
+			// only target proxies, other proxies like pprof keep their upstream
+			if removeSuffix(key) == "proxy" {
+				child.args = strings.SplitN(child.args, " ", 2)[0] + " " + backend.args
+			}
+		}
+		subdomainSites[subdomain] = subdomainSite
+	}
+	return subdomainSites, nil
+}
+
+func getSiteAddress(directive *directiveData) string {
+	if directive.name != "" {
+		return directive.name
+	}
+	return directive.args
+}
+
+func convertCompressLevel(directive *directiveData) error {
+	compressLevel := directive.children["compress_level"]
+	if compressLevel == nil {
+		return nil
+	}
+	delete(directive.children, "compress_level")
+
+	if gzipLevel := compressLevel.children["gzip"]; gzipLevel != nil {
+		if err := validateRange("compress_level.gzip", gzipLevel.args, 1, 9); err != nil {
+			return err
+		}
+		getOrCreateDirective(directive, "gzip.level").args = gzipLevel.args
+	}
+	if zstdLevel := compressLevel.children["zstd"]; zstdLevel != nil {
+		if err := validateRange("compress_level.zstd", zstdLevel.args, 1, 20); err != nil {
+			return err
+		}
+		directive.comments = append(directive.comments, "compress_level.zstd ignored, caddy doesn't support zstd compression")
+	}
+	return nil
+}
+
+func validateRange(label string, value string, min int, max int) error {
+	if number, err := strconv.Atoi(value); err != nil || number < min || number > max {
+		return fmt.Errorf("Invalid %s %q, expected a number from %d to %d", label, value, min, max)
+	}
+	return nil
+}
+
+// convertCustomDirectives writes custom_directive label values verbatim as
+// lines inside the site block
+func convertCustomDirectives(directive *directiveData) {
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) != "custom_directive" {
+			continue
+		}
+		custom := directive.children[key]
+		custom.name = custom.args
+		custom.args = ""
+		custom.children = nil
+		custom.comments = append(custom.comments, "custom directive, value is not sanitized")
+	}
+}
+
+// getTargetProxyDirective returns the proxy directive generated for the target,
+// labels configuring it would generate an invalid proxy without a targetport
+func getTargetProxyDirective(directive *directiveData, label string) (*directiveData, error) {
+	proxyDirective := directive.children["proxy"]
+	if proxyDirective == nil || proxyDirective.args == "" {
+		return nil, fmt.Errorf("Cannot use %s without a targetport", label)
+	}
+	return proxyDirective, nil
+}
+
+// convertFallback adds fallback upstreams after the target, using the first
+// policy so they only receive requests while the target is down
+func convertFallback(directive *directiveData) error {
+	var fallbacks []string
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) == "fallback" {
+			fallbacks = append(fallbacks, strings.Fields(directive.children[key].args)...)
+			delete(directive.children, key)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return nil
+	}
+
+	proxyDirective, err := getTargetProxyDirective(directive, "fallback")
+	if err != nil {
+		return err
+	}
+	proxyDirective.args += " " + strings.Join(fallbacks, " ")
+	if proxyDirective.children["policy"] == nil {
+		getOrCreateDirective(proxyDirective, "policy").args = "first"
+	}
+	if proxyDirective.children["fail_timeout"] == nil {
+		getOrCreateDirective(proxyDirective, "fail_timeout").args = "10s"
+	}
+	return nil
+}
+
+// convertErrorHandlers serves error pages by status code, all matches every status
+func convertErrorHandlers(directive *directiveData) error {
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) != "error_handler" {
+			continue
+		}
+		errorHandler := directive.children[key]
+		delete(directive.children, key)
+
+		for _, status := range getSortedKeys(&errorHandler.children) {
+			page := errorHandler.children[status].args
+			if len(strings.Fields(page)) != 1 {
+				directive.comments = append(directive.comments,
+					fmt.Sprintf("%s.%s %s ignored, caddy error pages are static files, set the path of an error page file", key, status, page))
+				continue
+			}
+			if status == "all" {
+				status = "*"
+			} else if err := validateRange(key+"."+status, status, 400, 599); err != nil {
+				return err
+			}
+			addChildDirective(getOrCreateDirective(directive, "errors"), status, status, page)
+		}
+	}
+	return nil
+}
+
+// removeUnsupportedLabel removes a label caddy can't implement, leaving a comment
+// in place of an invalid directive that would break the whole caddyfile
+func removeUnsupportedLabel(directive *directiveData, label string, reason string) {
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) != label {
+			continue
+		}
+		delete(directive.children, key)
+
+		directive.comments = append(directive.comments, fmt.Sprintf("%s ignored, %s", key, reason))
+	}
+}
+
+// convertPaths restricts the proxy directive to the paths in path labels,
+// creating one proxy directive per path
+func convertPaths(directive *directiveData) {
+	var paths []string
+	for _, key := range getSortedKeys(&directive.children) {
+		if removeSuffix(key) == "path" {
+			paths = append(paths, strings.TrimSuffix(directive.children[key].args, "*"))
+			delete(directive.children, key)
+		}
+	}
+
+	proxyDirective := directive.children["proxy"]
+	if len(paths) == 0 || proxyDirective == nil {
+		return
+	}
+
+	proxyTarget := proxyDirective.args
+	if index := strings.Index(proxyTarget, " "); index >= 0 {
+		proxyTarget = proxyTarget[index+1:]
+	}
+
+	if len(paths) == 1 {
+		proxyDirective.args = paths[0] + " " + proxyTarget
+		return
+	}
+
+	delete(directive.children, "proxy")
+	for i, path := range paths {
+		pathProxyDirective := cloneDirective(proxyDirective)
+		pathProxyDirective.args = path + " " + proxyTarget
+		directive.children[fmt.Sprintf("proxy_%d", i)] = pathProxyDirective
+	}
+}
+
+func cloneDirective(directive *directiveData) *directiveData {
+	clone := &directiveData{name: directive.name, args: directive.args, comments: directive.comments}
+	if directive.children != nil {
+		clone.children = map[string]*directiveData{}
+		for key, child := range directive.children {
+			clone.children[key] = cloneDirective(child)
+		}
+	}
+	return clone
+}
+
+func addChildDirective(directive *directiveData, key string, name string, args string) *directiveData {
+	if directive.children == nil {
+		directive.children = map[string]*directiveData{}
+	}
+	child := &directiveData{name: name, args: args}
+	directive.children[key] = child
+	return child
+}
+
+func quoteArg(arg string) string {
+	return "\"" + strings.Replace(arg, "\"", "\\\"", -1) + "\""
+}
+
+func getOrCreateDirective(directive *directiveData, path string) *directiveData {
+	currentDirective := directive
+
+	for _, p := range strings.Split(path, ".") {
+		if d, ok := currentDirective.children[p]; ok {
+			currentDirective = d
+		} else {
+			if currentDirective.children == nil {
+				currentDirective.children = map[string]*directiveData{}
+			}
+			var newDirective = directiveData{}
+			newDirective.name = removeSuffix(p)
+			currentDirective.children[p] = &newDirective
+			currentDirective = &newDirective
+		}
+	}
+
+	return currentDirective
+}
+
+func (g *CaddyfileGenerator) convertLabelsToDirectives(labels map[string]string, templateData interface{}, rootDirective *directiveData) {
+	templateData = g.addTemplateEnv(labels, templateData)
+	for label, value := range labels {
+		if !g.labelRegex.MatchString(label) {
+			continue
+		}
+		directive := rootDirective
+		path := strings.Split(label, ".")
+		if isEnvLabel(path) {
+			continue
+		}
+		for i, p := range path {
 			if d, ok := directive.children[p]; ok {
 				directive = d
 			} else {
@@ -311,22 +3133,83 @@ func (g *CaddyfileGenerator) convertLabelsToDirectives(labels map[string]string,
 				directive = &newDirective
 			}
 		}
-		directive.args = processVariables(templateData, value)
+		directive.args = processVariables(templateData, value, g.templateTimeout)
+	}
+}
+
+type containerTemplateData struct {
+	*types.Container
+	Env map[string]string
+}
+
+type serviceTemplateData struct {
+	*swarm.Service
+	Env map[string]string
+}
+
+// addTemplateEnv makes env labels available to templates as .Env, mapping
+// short names to caddy environment variable placeholders
+func (g *CaddyfileGenerator) addTemplateEnv(labels map[string]string, templateData interface{}) interface{} {
+	env := map[string]string{}
+	for label, value := range labels {
+		if !g.labelRegex.MatchString(label) {
+			continue
+		}
+		if path := strings.Split(label, "."); isEnvLabel(path) {
+			env[path[2]] = "{$" + value + "}"
+		}
+	}
+
+	switch target := templateData.(type) {
+	case *types.Container:
+		return &containerTemplateData{target, env}
+	case *swarm.Service:
+		return &serviceTemplateData{target, env}
 	}
+	return templateData
+}
+
+func isEnvLabel(path []string) bool {
+	return len(path) == 3 && path[1] == "env"
 }
 
-func processVariables(data interface{}, content string) string {
+// processVariables executes label templates, returning the label unprocessed when
+// the template doesn't finish within timeout so it can't block the generation.
+// Go can't stop a running template, so a template that never finishes leaks its goroutine
+func processVariables(data interface{}, content string, timeout time.Duration) string {
+	if !strings.Contains(content, "{{") {
+		return content
+	}
+
 	t, err := template.New("").Parse(content)
 	if err != nil {
 		log.Println(err)
 		return content
 	}
-	var writer bytes.Buffer
-	t.Execute(&writer, data)
-	return writer.String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan string, 1)
+	go func() {
+		var writer bytes.Buffer
+		t.Execute(&writer, data)
+		done <- writer.String()
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+		log.Printf("[WARNING] Template %q didn't finish within %v, using it unprocessed\n", content, timeout)
+		return content
+	}
 }
 
 func writeDirective(buffer *bytes.Buffer, directive *directiveData, level int) {
+	for _, comment := range directive.comments {
+		buffer.WriteString(strings.Repeat(" ", level*2) + "# " + comment + "\n")
+	}
 	buffer.WriteString(strings.Repeat(" ", level*2))
 	if directive.name != "" {
 		buffer.WriteString(directive.name)
@@ -370,4 +3253,5 @@ type directiveData struct {
 	name     string
 	args     string
 	children map[string]*directiveData
+	comments []string
 }
@@ -3,11 +3,14 @@ package plugin
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -418,6 +421,4343 @@ func TestIgnoreLabelsWithoutCaddyPrefix(t *testing.T) {
 	testSingleService(t, true, service, expected)
 }
 
+func TestAddServiceWithAuthDelay(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.delay" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.auth_delay"):      "500ms",
+					fmtLabel("%s.auth_delay.path"): "/login",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  delay /login 500ms\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	isPluginInstalled = func(name string) bool { return false }
+
+	const expectedWithoutPlugin string = "# auth_delay ignored, install the http.delay plugin to delay responses\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedWithoutPlugin)
+}
+
+func TestAddServiceWithInvalidAuthDelay(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.auth_delay"): "half a second",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# Invalid auth_delay \"half a second\", expected a duration like 500ms\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestIgnoreContainersOption(t *testing.T) {
+	var container = &types.Container{
+		ID: "CONTAINER-ID",
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):    "service.testdomain.com",
+			fmtLabel("%s.targetport"): "5000",
+		},
+	}
+
+	var buffer bytes.Buffer
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+		IgnoreContainers: func(c *types.Container) bool {
+			return c.ID == "CONTAINER-ID"
+		},
+	})
+	generator.caddyNetworks = map[string]bool{}
+	generator.caddyNetworks[caddyNetworkID] = true
+	generator.addContainerToCaddyFile(&buffer, container)
+	assert.Equal(t, "", buffer.String())
+}
+
+func TestIgnoreServicesOption(t *testing.T) {
+	var service = &swarm.Service{
+		ID: "SERVICE-ID",
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	var buffer bytes.Buffer
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+		IgnoreServices: func(s *swarm.Service) bool {
+			return s.Spec.Name == "service"
+		},
+	})
+	generator.caddyNetworks = map[string]bool{}
+	generator.caddyNetworks[caddyNetworkID] = true
+	generator.addServiceToCaddyFile(&buffer, service)
+	assert.Equal(t, "", buffer.String())
+}
+
+func TestAddServiceWithUpstreamHeaders(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                      "service.testdomain.com",
+					fmtLabel("%s.targetport"):                   "5000",
+					fmtLabel("%s.upstream_headers.X-Tenant-ID"): "{$TENANT}",
+					fmtLabel("%s.upstream_headers.X-Service"):   "{{.Spec.Name}}",
+					fmtLabel("%s.delete_upstream_headers"):      "Cookie Authorization",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream -Authorization\n" +
+		"    header_upstream -Cookie\n" +
+		"    header_upstream X-Service \"service\"\n" +
+		"    header_upstream X-Tenant-ID \"{$TENANT}\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithDownstreamHeaders(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                         "service.testdomain.com",
+					fmtLabel("%s.targetport"):                      "5000",
+					fmtLabel("%s.downstream_headers.X-Powered-By"): "~",
+					fmtLabel("%s.downstream_headers.Server"):       "~",
+					fmtLabel("%s.downstream_headers.X-Frame"):      "DENY",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_downstream -Server\n" +
+		"    header_downstream -X-Powered-By\n" +
+		"    header_downstream X-Frame \"DENY\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestMergeInheritedLabels(t *testing.T) {
+	containers := map[string]map[string]string{
+		"parent": map[string]string{
+			fmtLabel("%s.address"):    "parent.testdomain.com",
+			fmtLabel("%s.targetport"): "5000",
+			fmtLabel("%s.gzip"):       "",
+		},
+	}
+	labels := map[string]string{
+		fmtLabel("%s.address"):      "child.testdomain.com",
+		fmtLabel("%s.inherit_from"): "parent",
+	}
+
+	merged, err := mergeInheritedLabels("CHILD-ID", labels, fmtLabel("%s.inherit_from"), func(reference string) (string, map[string]string, error) {
+		return reference, containers[reference], nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		fmtLabel("%s.address"):    "child.testdomain.com",
+		fmtLabel("%s.targetport"): "5000",
+		fmtLabel("%s.gzip"):       "",
+	}, merged)
+}
+
+func TestMergeInheritedLabelsCircular(t *testing.T) {
+	containers := map[string]map[string]string{
+		"first": map[string]string{
+			fmtLabel("%s.inherit_from"): "second",
+		},
+		"second": map[string]string{
+			fmtLabel("%s.inherit_from"): "first",
+		},
+	}
+
+	_, err := mergeInheritedLabels("first", containers["first"], fmtLabel("%s.inherit_from"), func(reference string) (string, map[string]string, error) {
+		return reference, containers[reference], nil
+	})
+
+	assert.EqualError(t, err, "Container first has circular inheritance through first")
+}
+
+func TestAddServiceWithPaths(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.path_0"):          "/api/*",
+					fmtLabel("%s.path_1"):          "/health",
+					fmtLabel("%s.proxy.websocket"): "",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy /api/ service:5000 {\n" +
+		"    websocket\n" +
+		"  }\n" +
+		"  proxy /health service:5000 {\n" +
+		"    websocket\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddContainerWithPath(t *testing.T) {
+	var container = &types.Container{
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):    "service.testdomain.com",
+			fmtLabel("%s.targetport"): "5000",
+			fmtLabel("%s.path"):       "/api",
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy /api 172.17.0.2:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+}
+
+func TestAddServiceWithHostAliases(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):      "example.com",
+					fmtLabel("%s.targetport"):   "5000",
+					fmtLabel("%s.host_alias_0"): "www.example.com api.example.com",
+					fmtLabel("%s.host_alias_1"): "{{.Spec.Name}}.example.com",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "example.com, www.example.com, api.example.com, service.example.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	delete(service.Spec.Labels, fmtLabel("%s.address"))
+
+	const expectedWithoutAddress string = "www.example.com, api.example.com, service.example.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedWithoutAddress)
+
+	service.Spec.Labels[fmtLabel("%s.default_site")] = "1"
+
+	const expectedDefaultSite string = "# Cannot add host_alias to :80, it already matches every host\n"
+
+	testSingleService(t, false, service, expectedDefaultSite)
+}
+
+func TestAddServiceWithAcmeIssuer(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):           "service.testdomain.com",
+					fmtLabel("%s.targetport"):        "5000",
+					fmtLabel("%s.acme_issuer"):       "https://acme-staging-v02.api.letsencrypt.org/directory",
+					fmtLabel("%s.acme_issuer.email"): "admin@testdomain.com",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls admin@testdomain.com {\n" +
+		"    ca https://acme-staging-v02.api.letsencrypt.org/directory\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithInternalAcmeIssuer(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):     "service.testdomain.com",
+					fmtLabel("%s.targetport"):  "5000",
+					fmtLabel("%s.acme_issuer"): "internal",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls self_signed\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithMaxConnections(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                 "service.testdomain.com",
+					fmtLabel("%s.targetport"):              "5000",
+					fmtLabel("%s.max_connections"):         "100",
+					fmtLabel("%s.max_connections.retries"): "3",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # max_connections.retries 3 ignored, caddy proxy doesn't support a retry count, use proxy.try_duration instead\n" +
+		"  proxy / service:5000 {\n" +
+		"    max_conns 100\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithKeepalive(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):             "service.testdomain.com",
+					fmtLabel("%s.targetport"):          "5000",
+					fmtLabel("%s.keepalive.pool_size"): "20",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    keepalive 20\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithKeepaliveOff(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):             "service.testdomain.com",
+					fmtLabel("%s.targetport"):          "5000",
+					fmtLabel("%s.keepalive.pool_size"): "20",
+					fmtLabel("%s.keepalive.off"):       "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    keepalive 0\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithAccessLogFormat(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                  "service.testdomain.com",
+					fmtLabel("%s.targetport"):               "5000",
+					fmtLabel("%s.access_log_format"):        "json",
+					fmtLabel("%s.access_log_format.fields"): "method uri status",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  log / stdout \"\\{\\\"method\\\":\\\"{method}\\\",\\\"uri\\\":\\\"{uri}\\\",\\\"status\\\":\\\"{status}\\\"\\}\"\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithCombinedAccessLogFormat(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):           "service.testdomain.com",
+					fmtLabel("%s.targetport"):        "5000",
+					fmtLabel("%s.access_log_format"): "combined",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  log / stdout \"{combined}\"\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithPush(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.push"):       "/static/app.js /static/style.css",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  # HTTP/2 push is removed in caddy v2, replace it with 103 Early Hints when migrating\n" +
+		"  push / /static/app.js /static/style.css\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithBrowse(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.root"):            "/srv/docs",
+					fmtLabel("%s.browse"):          "1",
+					fmtLabel("%s.browse.template"): "/srv/browse.tpl",
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  browse / /srv/browse.tpl\n" +
+		"  root /srv/docs\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithBrowseWithoutRoot(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"): "service.testdomain.com",
+					fmtLabel("%s.browse"):  "true",
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # browse implies serving static files from the site root, set caddy.root to choose the folder\n" +
+		"  browse /\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithTLSInsecureSkipVerify(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                  "service.testdomain.com",
+					fmtLabel("%s.targetport"):               "5000",
+					fmtLabel("%s.targetprotocol"):           "https",
+					fmtLabel("%s.tls_insecure_skip_verify"): "true",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # WARNING: TLS verification of service is disabled, provide its CA certificate with caddy.proxy.ca_certificates instead\n" +
+		"  proxy / https://service:5000 {\n" +
+		"    insecure_skip_verify\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddContainerWithTLSInsecureSkipVerifyWithoutHttps(t *testing.T) {
+	var container = &types.Container{
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):                  "service.testdomain.com",
+			fmtLabel("%s.targetport"):               "5000",
+			fmtLabel("%s.tls_insecure_skip_verify"): "true",
+		},
+	}
+
+	const expected string = "# tls_insecure_skip_verify ignored, it requires targetprotocol https\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+}
+
+func TestAddServiceWithWebsocketLabels(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                 "service.testdomain.com",
+					fmtLabel("%s.targetport"):              "5000",
+					fmtLabel("%s.websocket"):               "1",
+					fmtLabel("%s.websocket_timeout"):       "1h",
+					fmtLabel("%s.websocket_ping_interval"): "30s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# websocket_timeout 1h ignored, caddy proxy timeout only limits connecting to the upstream, websockets have no idle timeout\n" +
+		"service.testdomain.com {\n" +
+		"  # websocket_ping_interval 30s ignored, caddy proxy doesn't send websocket pings\n" +
+		"  proxy / service:5000 {\n" +
+		"    websocket\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithInvalidWebsocketTimeout(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):           "service.testdomain.com",
+					fmtLabel("%s.targetport"):        "5000",
+					fmtLabel("%s.websocket_timeout"): "forever",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# Invalid websocket_timeout \"forever\", expected a duration like 500ms\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithTrace(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.trace"):      "w3c",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream traceparent {>traceparent}\n" +
+		"    header_upstream tracestate {>tracestate}\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithCompressTypes(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                          "service.testdomain.com",
+					fmtLabel("%s.targetport"):                       "5000",
+					fmtLabel("%s.compress_types"):                   "text/html text/css",
+					fmtLabel("%s.compress_types.compress_min_size"): "1024",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # compress_types text/html text/css ignored, caddy gzip can't filter by content type, use caddy.gzip.ext instead\n" +
+		"  gzip {\n" +
+		"    min_length 1024\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestStaticBlocks(t *testing.T) {
+	var buffer bytes.Buffer
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.AddStaticBlock("b", "b.testdomain.com {\n  root /srv/b\n}\n")
+	generator.AddStaticBlock("a", "a.testdomain.com {\n  root /srv/a\n}")
+	generator.AddStaticBlock("c", "c.testdomain.com")
+	generator.AddStaticBlock("a", "a.testdomain.com {\n  root /srv/new-a\n}")
+	generator.RemoveStaticBlock("c")
+	generator.addStaticBlocks(&buffer)
+
+	const expected string = "a.testdomain.com {\n" +
+		"  root /srv/new-a\n" +
+		"}\n" +
+		"b.testdomain.com {\n" +
+		"  root /srv/b\n" +
+		"}\n"
+
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestAddServiceWithLogSampler(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):           "service.testdomain.com",
+					fmtLabel("%s.targetport"):        "5000",
+					fmtLabel("%s.log"):               "/ stdout",
+					fmtLabel("%s.log_sampler"):       "10",
+					fmtLabel("%s.log_sampler.first"): "10",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# log_sampler ignored, caddy log doesn't support sampling\n" +
+		"service.testdomain.com {\n" +
+		"  log / stdout\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithProxyProtocol(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):        "service.testdomain.com",
+					fmtLabel("%s.targetport"):     "5000",
+					fmtLabel("%s.proxy_protocol"): "v2",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# proxy_protocol ignored, caddy proxy can't send PROXY protocol headers to upstreams\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithDNS(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.dns"):        "cloudflare",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls {\n" +
+		"    dns cloudflare\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithUnknownDNSProvider(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):      "service.testdomain.com",
+					fmtLabel("%s.targetport"):   "5000",
+					fmtLabel("%s.dns"):          "cloudflare",
+					fmtLabel("%s.dns.provider"): "mydns",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls {\n" +
+		"    # WARNING: unknown dns provider mydns\n" +
+		"    dns mydns\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithClientCert(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):          "service.testdomain.com",
+					fmtLabel("%s.targetport"):       "5000",
+					fmtLabel("%s.client_cert"):      "1",
+					fmtLabel("%s.client_cert.mode"): "verify_if_given",
+					fmtLabel("%s.client_cert_ca"):   "/certs/ca.crt",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls {\n" +
+		"    clients verify_if_given /certs/ca.crt\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithInvalidClientCertMode(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):          "service.testdomain.com",
+					fmtLabel("%s.targetport"):       "5000",
+					fmtLabel("%s.client_cert"):      "1",
+					fmtLabel("%s.client_cert.mode"): "always",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# Invalid client_cert.mode \"always\", expected request, require, verify_if_given or require_and_verify\n"
+
+	testSingleService(t, false, service, expected)
+	service.Spec.Labels[fmtLabel("%s.client_cert.mode")] = "require_and_verify"
+
+	const expectedWithoutCA string = "# client_cert requires client_cert_ca to verify clients, unless client_cert.mode is request or require\n"
+
+	testSingleService(t, false, service, expectedWithoutCA)
+
+	service.Spec.Labels[fmtLabel("%s.client_cert.mode")] = "require"
+
+	const expectedRequire string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls {\n" +
+		"    clients require\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedRequire)
+}
+
+func TestAddServiceWithRedirectFrom(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "new.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.redirect_from_0"):        "old.testdomain.com",
+					fmtLabel("%s.redirect_from_1"):        "legacy.testdomain.com",
+					fmtLabel("%s.redirect_from_1.target"): "http://other.testdomain.com/",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "new.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n" +
+		"old.testdomain.com {\n" +
+		"  redir https://new.testdomain.com{uri} 301\n" +
+		"}\n" +
+		"legacy.testdomain.com {\n" +
+		"  redir http://other.testdomain.com{uri} 301\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithUpstreamResponseTimeout(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                   "service.testdomain.com",
+					fmtLabel("%s.targetport"):                "5000",
+					fmtLabel("%s.timeout.upstream_response"): "0",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  timeouts {\n" +
+		"    write 0\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.timeout.upstream_response")] = "30s"
+
+	const expectedLimit string = "# timeout.upstream_response 30s ignored, caddy can't limit upstream responses, only 0 is supported to disable the write timeout\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedLimit)
+
+	service.Spec.Labels[fmtLabel("%s.timeout")] = "30s"
+
+	const expectedTimeout string = "# timeout.upstream_response 30s ignored, caddy can't limit upstream responses, only 0 is supported to disable the write timeout\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  timeout 30s\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedTimeout)
+}
+
+func TestAddServiceWithServicePolicy(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):        "service.testdomain.com",
+					fmtLabel("%s.targetport"):     "5000",
+					fmtLabel("%s.service_policy"): "vip",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, true, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.service_policy")] = "tasks"
+
+	const expectedTasks string = "service.testdomain.com {\n" +
+		"  proxy / tasks.service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedTasks)
+}
+
+func TestAddServiceWithTLSVersions(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.tls_min_version"): "1.2",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls {\n" +
+		"    protocols tls1.2 tls1.3\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithInvalidTLSVersion(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.tls_max_version"): "2.0",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# Invalid tls_max_version \"2.0\", expected one of 1.0, 1.1, 1.2, 1.3\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithRedirectScheme(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.redirect_scheme"): "https",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  redir 301 {\n" +
+		"    / https://{host}{uri}\n" +
+		"    if {scheme} is http\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithRedirectSchemeToSameScheme(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "https://service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.redirect_scheme"): "https",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# redirect_scheme https ignored, site address already uses https\n" +
+		"https://service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithMap(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):            "service.testdomain.com",
+					fmtLabel("%s.targetport"):         "5000",
+					fmtLabel("%s.map.input"):          "{host}",
+					fmtLabel("%s.map.output.tenant1"): "backend1:8080",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# map ignored, caddy doesn't support choosing upstreams with a map directive\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithDenyPaths(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):     "service.testdomain.com",
+					fmtLabel("%s.targetport"):  "5000",
+					fmtLabel("%s.deny_path_0"): "/.git /.env",
+					fmtLabel("%s.deny_path_1"): "/wp-admin",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  status 403 {\n" +
+		"    /.env\n" +
+		"    /.git\n" +
+		"    /wp-admin\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithAllowPaths(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.allow_path"): "/api/* /health",
+					fmtLabel("%s.deny_path"):  "/.git",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  rewrite {\n" +
+		"    if {path} not_starts_with /.git\n" +
+		"    if {path} not_starts_with /api/\n" +
+		"    if {path} not_starts_with /health\n" +
+		"    if_op and\n" +
+		"    to /caddy-docker-proxy-not-allowed\n" +
+		"  }\n" +
+		"  status 404 /caddy-docker-proxy-not-allowed\n" +
+		"  status 403 {\n" +
+		"    /.git\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.redirect_trailing_slash")] = "remove"
+
+	const expectedTrailingSlash string = "# Cannot combine allow_path with redirect_trailing_slash, caddy applies a single rewrite per request\n"
+
+	testSingleService(t, false, service, expectedTrailingSlash)
+
+	delete(service.Spec.Labels, fmtLabel("%s.redirect_trailing_slash"))
+	service.Spec.Labels[fmtLabel("%s.request_transform.url")] = "^/v1/(.*) /api/v2/{1}"
+
+	const expectedRequestTransform string = "# Cannot combine allow_path with request_transform.url, caddy applies a single rewrite per request\n"
+
+	testSingleService(t, false, service, expectedRequestTransform)
+}
+
+func TestAddServiceWithCompressLevel(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):             "service.testdomain.com",
+					fmtLabel("%s.targetport"):          "5000",
+					fmtLabel("%s.compress_level.gzip"): "6",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  gzip {\n" +
+		"    level 6\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithInvalidCompressLevel(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):             "service.testdomain.com",
+					fmtLabel("%s.targetport"):          "5000",
+					fmtLabel("%s.compress_level.gzip"): "12",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# Invalid compress_level.gzip \"12\", expected a number from 1 to 9\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithCache(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.cache" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.cache"):      "1",
+					fmtLabel("%s.cache.ttl"):  "5m",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  cache {\n" +
+		"    default_max_age 5m\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithCacheWithoutPlugin(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return false }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.cache"):      "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# cache ignored, install the http.cache plugin to enable caching\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithCircuitBreaker(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "service.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.circuit_breaker.window"): "10s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    fail_timeout 10s\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithInvalidCircuitBreakerThreshold(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                   "service.testdomain.com",
+					fmtLabel("%s.targetport"):                "5000",
+					fmtLabel("%s.circuit_breaker.threshold"): "1.5",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# Invalid circuit_breaker.threshold \"1.5\", expected a number from 0 to 1\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithRetryPolicy(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                   "service.testdomain.com",
+					fmtLabel("%s.targetport"):                "5000",
+					fmtLabel("%s.retry_policy.attempts"):     "3",
+					fmtLabel("%s.retry_policy.backoff"):      "100ms",
+					fmtLabel("%s.retry_policy.allow_unsafe"): "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # retry_policy.allow_unsafe 1 ignored, caddy proxy only retries failed connections, which is safe for every method\n" +
+		"  proxy / service:5000 {\n" +
+		"    try_duration 300ms\n" +
+		"    try_interval 100ms\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithBufferLabels(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):          "service.testdomain.com",
+					fmtLabel("%s.targetport"):       "5000",
+					fmtLabel("%s.buffer_requests"):  "10MB",
+					fmtLabel("%s.buffer_responses"): "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# buffer_requests ignored, caddy proxy always streams requests to upstreams\n" +
+		"# buffer_responses ignored, caddy proxy always streams responses from upstreams\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithSubdomainRouting(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                   "*.app.testdomain.com",
+					fmtLabel("%s.targetport"):                "5000",
+					fmtLabel("%s.proxy.transparent"):         "",
+					fmtLabel("%s.subdomain_routing"):         "1",
+					fmtLabel("%s.subdomain_routing.tenant1"): "tenant1-backend:8080",
+					fmtLabel("%s.subdomain_routing.tenant2"): "tenant2-backend:8080",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "*.app.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    transparent\n" +
+		"  }\n" +
+		"}\n" +
+		"tenant1.app.testdomain.com {\n" +
+		"  proxy / tenant1-backend:8080 {\n" +
+		"    transparent\n" +
+		"  }\n" +
+		"}\n" +
+		"tenant2.app.testdomain.com {\n" +
+		"  proxy / tenant2-backend:8080 {\n" +
+		"    transparent\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+	delete(service.Spec.Labels, fmtLabel("%s.proxy.transparent"))
+	delete(service.Spec.Labels, fmtLabel("%s.subdomain_routing.tenant2"))
+	service.Spec.Labels[fmtLabel("%s.pprof")] = "1"
+
+	const expectedPprof string = "*.app.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  proxy /debug/pprof service:6060\n" +
+		"  rewrite /debug/pprof {\n" +
+		"    if {remote} not 127.0.0.1\n" +
+		"    if {remote} not ::1\n" +
+		"    if_op and\n" +
+		"    to /caddy-docker-proxy-not-trusted\n" +
+		"  }\n" +
+		"  status 403 /caddy-docker-proxy-not-trusted\n" +
+		"}\n" +
+		"tenant1.app.testdomain.com {\n" +
+		"  proxy / tenant1-backend:8080\n" +
+		"  proxy /debug/pprof service:6060\n" +
+		"  rewrite /debug/pprof {\n" +
+		"    if {remote} not 127.0.0.1\n" +
+		"    if {remote} not ::1\n" +
+		"    if_op and\n" +
+		"    to /caddy-docker-proxy-not-trusted\n" +
+		"  }\n" +
+		"  status 403 /caddy-docker-proxy-not-trusted\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedPprof)
+}
+
+func TestContainersCache(t *testing.T) {
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.containersCache.containers = map[string]*types.Container{
+		"OLD-ID": &types.Container{ID: "OLD-ID", Created: 1},
+		"NEW-ID": &types.Container{ID: "NEW-ID", Created: 2},
+	}
+	generator.containersCache.updated = time.Now()
+
+	containers, err := generator.getContainers()
+	assert.Nil(t, err)
+	assert.Equal(t, []types.Container{
+		types.Container{ID: "NEW-ID", Created: 2},
+		types.Container{ID: "OLD-ID", Created: 1},
+	}, containers)
+
+	generator.UpdateContainer("exec_start", "NEW-ID")
+	generator.UpdateContainer("stop", "OLD-ID")
+
+	containers, err = generator.getContainers()
+	assert.Nil(t, err)
+	assert.Equal(t, []types.Container{
+		types.Container{ID: "NEW-ID", Created: 2},
+	}, containers)
+	assert.Equal(t, 2, generator.containersCache.hits)
+	assert.Equal(t, 0, generator.containersCache.misses)
+}
+
+func TestAddServiceWithDiscoveryMode(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "service.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.service_discovery_mode"): "ip",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+					Addr:      "10.0.0.5/24",
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / 10.0.0.5:5000\n" +
+		"}\n"
+
+	testSingleService(t, true, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.service_discovery_mode")] = "dns"
+
+	const expectedDNS string = "service.testdomain.com {\n" +
+		"  proxy / tasks.service:5000\n" +
+		"}\n"
+
+	testSingleService(t, true, service, expectedDNS)
+
+	service.Spec.Labels[fmtLabel("%s.service_discovery_mode")] = "magic"
+
+	const expectedInvalid string = "# Invalid service_discovery_mode \"magic\", expected dns, ip or task_ips\n"
+
+	testSingleService(t, true, service, expectedInvalid)
+}
+
+func TestAddServiceWithCustomDirectives(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):            "service.testdomain.com",
+					fmtLabel("%s.targetport"):         "5000",
+					fmtLabel("%s.custom_directive"):   "jwt /api",
+					fmtLabel("%s.custom_directive_1"): "minify",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # custom directive, value is not sanitized\n" +
+		"  jwt /api\n" +
+		"  # custom directive, value is not sanitized\n" +
+		"  minify\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithPort(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.host_alias"): "alias.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.port"):       "8080",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com:8080, alias.testdomain.com:8080 {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.port")] = "80"
+
+	const expectedHTTP string = "http://service.testdomain.com, http://alias.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedHTTP)
+
+	service.Spec.Labels[fmtLabel("%s.port")] = "http"
+
+	const expectedInvalid string = "# Invalid port \"http\", expected a number from 1 to 65535\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+
+	delete(service.Spec.Labels, fmtLabel("%s.host_alias"))
+	service.Spec.Labels[fmtLabel("%s.address")] = "https://service.testdomain.com/api"
+	service.Spec.Labels[fmtLabel("%s.port")] = "8443"
+
+	const expectedScheme string = "https://service.testdomain.com:8443/api {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedScheme)
+
+	service.Spec.Labels[fmtLabel("%s.port")] = "80"
+
+	const expectedSchemeConflict string = "# Cannot set port 80 on address \"https://service.testdomain.com/api\", it uses the https scheme\n"
+
+	testSingleService(t, false, service, expectedSchemeConflict)
+
+	service.Spec.Labels[fmtLabel("%s.address")] = "service.testdomain.com:8080"
+	service.Spec.Labels[fmtLabel("%s.port")] = "8080"
+
+	const expectedSamePort string = "service.testdomain.com:8080 {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedSamePort)
+
+	service.Spec.Labels[fmtLabel("%s.port")] = "9090"
+
+	const expectedPortConflict string = "# Cannot set port 9090 on address \"service.testdomain.com:8080\", it already has port 8080\n"
+
+	testSingleService(t, false, service, expectedPortConflict)
+}
+
+func TestAddContainerWithNetworkAlias(t *testing.T) {
+	var container = &types.Container{
+		ID: "container-id",
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+					Aliases:   []string{"web", "web-blue"},
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):       "service.testdomain.com",
+			fmtLabel("%s.targetport"):    "5000",
+			fmtLabel("%s.network_alias"): "true",
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / web:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+
+	container.Labels[fmtLabel("%s.network_alias")] = "web-blue"
+
+	const expectedNamed string = "service.testdomain.com {\n" +
+		"  proxy / web-blue:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expectedNamed)
+
+	container.Labels[fmtLabel("%s.network_alias")] = "web-green"
+
+	const expectedMissing string = "# Container container-id has no network alias web-green in caddy network\n"
+
+	testSingleContainer(t, container, expectedMissing)
+}
+
+func TestAddServiceWithAutoHTTPS(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.auto_https"): "off",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  tls off\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.auto_https")] = "disable_redirects"
+
+	const expectedRedirects string = "# auto_https disable_redirects ignored, caddy can't disable the http to https redirect of a single site\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedRedirects)
+
+	service.Spec.Labels[fmtLabel("%s.auto_https")] = "off"
+	service.Spec.Labels[fmtLabel("%s.tls_min_version")] = "1.2"
+
+	const expectedConflict string = "# Cannot combine auto_https off with tls labels\n"
+
+	testSingleService(t, false, service, expectedConflict)
+
+	delete(service.Spec.Labels, fmtLabel("%s.tls_min_version"))
+	service.Spec.Labels[fmtLabel("%s.acme_issuer")] = "internal"
+
+	testSingleService(t, false, service, expectedConflict)
+}
+
+func TestAddServiceWithLogSkipPaths(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):           "service.testdomain.com",
+					fmtLabel("%s.targetport"):        "5000",
+					fmtLabel("%s.log_skip_paths"):    "/healthz /ready",
+					fmtLabel("%s.access_log_format"): "common",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  log / stdout \"{common}\" {\n" +
+		"    except /healthz /ready\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	delete(service.Spec.Labels, fmtLabel("%s.access_log_format"))
+
+	const expectedDefault string = "service.testdomain.com {\n" +
+		"  log / stdout {\n" +
+		"    except /healthz /ready\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedDefault)
+}
+
+func TestAddServiceWithEnv(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                  "service.testdomain.com",
+					fmtLabel("%s.targetport"):               "5000",
+					fmtLabel("%s.env.TOKEN"):                "MY_SERVICE_TOKEN",
+					fmtLabel("%s.upstream_headers.X-Token"): "{{.Env.TOKEN}}",
+					fmtLabel("%s.upstream_headers.X-Name"):  "{{.Spec.Name}}",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream X-Name \"service\"\n" +
+		"    header_upstream X-Token \"{$MY_SERVICE_TOKEN}\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithPprof(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.pprof"):      "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  proxy /debug/pprof service:6060\n" +
+		"  rewrite /debug/pprof {\n" +
+		"    if {remote} not 127.0.0.1\n" +
+		"    if {remote} not ::1\n" +
+		"    if_op and\n" +
+		"    to /caddy-docker-proxy-not-trusted\n" +
+		"  }\n" +
+		"  status 403 /caddy-docker-proxy-not-trusted\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.pprof.port")] = "debug"
+
+	const expectedInvalid string = "# Invalid pprof.port \"debug\", expected a number from 1 to 65535\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithSetHeaderIf(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                         "service.testdomain.com",
+					fmtLabel("%s.targetport"):                      "5000",
+					fmtLabel("%s.set_header_if.X-Cache-Status"):    "MISS",
+					fmtLabel("%s.set_header_if_1.X-Frame-Options"): "DENY",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# set_header_if ignored, caddy header can't set a header only when it's missing\n" +
+		"# set_header_if_1 ignored, caddy header can't set a header only when it's missing\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithLogToFile(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):               "service.testdomain.com",
+					fmtLabel("%s.targetport"):            "5000",
+					fmtLabel("%s.log_to_file"):           "/var/log/caddy/{{.Spec.Name}}.log",
+					fmtLabel("%s.log_to_file.roll_size"): "100MB",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # directory of /var/log/caddy/service.log must exist, caddy doesn't create it\n" +
+		"  log / /var/log/caddy/service.log {\n" +
+		"    rotate_size 100\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.access_log_format")] = "combined"
+	delete(service.Spec.Labels, fmtLabel("%s.log_to_file.roll_size"))
+
+	const expectedFormat string = "service.testdomain.com {\n" +
+		"  # directory of /var/log/caddy/service.log must exist, caddy doesn't create it\n" +
+		"  log / /var/log/caddy/service.log \"{combined}\"\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedFormat)
+
+	service.Spec.Labels[fmtLabel("%s.log_to_file.roll_size")] = "large"
+
+	const expectedInvalid string = "# Invalid log_to_file.roll_size \"large\", expected a size in megabytes like 100MB\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithXFH(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.xfh"):        "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream X-Forwarded-Host {host}\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.xfh")] = "off"
+
+	const expectedOff string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream -X-Forwarded-Host\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedOff)
+
+	service.Spec.Labels[fmtLabel("%s.xfh")] = "maybe"
+
+	const expectedInvalid string = "# Invalid xfh \"maybe\", expected 1 or off\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+	service.Spec.Labels[fmtLabel("%s.xfh")] = "1"
+	delete(service.Spec.Labels, fmtLabel("%s.targetport"))
+
+	const expectedWithoutTarget string = "# Cannot use xfh without a targetport\n"
+
+	testSingleService(t, false, service, expectedWithoutTarget)
+}
+
+func TestAddServiceWithTracing(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.tracing"):         "1",
+					fmtLabel("%s.tracing.sampler"): "0.1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# tracing ignored, caddy can't create tracing spans, use caddy.trace to propagate trace headers\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithFallback(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.fallback"):   "fallback-backend:8080",
+					fmtLabel("%s.fallback_1"): "maintenance:80",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 fallback-backend:8080 maintenance:80 {\n" +
+		"    fail_timeout 10s\n" +
+		"    policy first\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	delete(service.Spec.Labels, fmtLabel("%s.targetport"))
+
+	const expectedInvalid string = "# Cannot use fallback without a targetport\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithRateLimit(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.ratelimit" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):              "service.testdomain.com",
+					fmtLabel("%s.targetport"):           "5000",
+					fmtLabel("%s.rate_limit"):           "/api 10 20 second",
+					fmtLabel("%s.rate_limit.by_header"): "X-Api-Key",
+					fmtLabel("%s.rate_limit.fallback"):  "ip",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  # rate_limit.fallback ip ignored, requests without the header share the same limit\n" +
+		"  ratelimit /api 10 20 second {\n" +
+		"    limit_by_header X-Api-Key\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	isPluginInstalled = func(name string) bool { return false }
+
+	const expectedNoPlugin string = "# rate_limit ignored, install the http.ratelimit plugin to enable rate limiting\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedNoPlugin)
+}
+
+func TestAddServiceWithMetricsPath(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.prometheus" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "service.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.metrics_path"):           "/metrics",
+					fmtLabel("%s.metrics_path.allow_ips"): "10.0.0.1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # metrics_path.allow_ips 10.0.0.1 ignored, caddy can't restrict the prometheus endpoint by IP\n" +
+		"  prometheus {\n" +
+		"    path /metrics\n" +
+		"    use_caddy_addr\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	isPluginInstalled = func(name string) bool { return false }
+
+	const expectedNoPlugin string = "# metrics_path ignored, install the http.prometheus plugin to expose metrics\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedNoPlugin)
+}
+
+func TestAddServiceWithCookieAttributes(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.cookie_secure"):   "1",
+					fmtLabel("%s.cookie_samesite"): "Strict",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_downstream Set-Cookie \"^(.*)$\" \"$1; Secure; SameSite=Strict\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.cookie_samesite")] = "Always"
+
+	const expectedInvalid string = "# Invalid cookie_samesite \"Always\", expected Strict, Lax or None\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithStripHeadersFromBackend(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                    "service.testdomain.com",
+					fmtLabel("%s.targetport"):                 "5000",
+					fmtLabel("%s.strip_headers_from_backend"): "Server X-Powered-By",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  header / {\n" +
+		"    -Server\n" +
+		"    -X-Powered-By\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestContainersSortedByUID(t *testing.T) {
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.containersCache.containers = map[string]*types.Container{
+		"A-ID": &types.Container{ID: "A-ID", Created: 3},
+		"B-ID": &types.Container{ID: "B-ID", Created: 1, Labels: map[string]string{fmtLabel("%s.uid"): "web"}},
+		"C-ID": &types.Container{ID: "C-ID", Created: 2, Labels: map[string]string{fmtLabel("%s.uid"): "api"}},
+	}
+	generator.containersCache.updated = time.Now()
+
+	containers, err := generator.getContainers()
+	assert.Nil(t, err)
+
+	var ids []string
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	assert.Equal(t, []string{"C-ID", "B-ID", "A-ID"}, ids)
+}
+
+func TestAddGlobalOptions(t *testing.T) {
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	containers := []types.Container{
+		types.Container{
+			ID: "GLOBAL-ID",
+			Labels: map[string]string{
+				fmtLabel("%s.global_config"): "1",
+				fmtLabel("%s.global.email"):  "admin@example.com",
+				fmtLabel("%s.global.debug"):  "",
+			},
+		},
+		types.Container{
+			ID: "OTHER-GLOBAL-ID",
+			Labels: map[string]string{
+				fmtLabel("%s.global_config"): "1",
+				fmtLabel("%s.global.admin"):  "off",
+			},
+		},
+	}
+
+	var buffer bytes.Buffer
+	generator.addGlobalOptions(&buffer, containers)
+
+	const expected string = "# global option debug ignored, caddy doesn't support a global options block, use command line flags\n" +
+		"# global option email admin@example.com ignored, caddy doesn't support a global options block, use command line flags\n"
+
+	assert.Equal(t, expected, buffer.String())
+
+	testSingleContainer(t, &containers[0], "")
+}
+
+func TestAddContainerWithDockerNet(t *testing.T) {
+	var container = &types.Container{
+		ID: "CONTAINER-ID",
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"other-network": &network.EndpointSettings{
+					IPAddress: "10.0.0.1",
+					NetworkID: "other-network-id",
+				},
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):    "service.testdomain.com",
+			fmtLabel("%s.targetport"): "5000",
+			fmtLabel("%s.docker_net"): "caddy-network",
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+
+	container.Labels[fmtLabel("%s.docker_net")] = "other-network"
+
+	const expectedNotCaddy string = "# Network other-network of container CONTAINER-ID is not a caddy network\n"
+
+	testSingleContainer(t, container, expectedNotCaddy)
+}
+
+func TestAddServiceWithSNIRouting(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):     "service.testdomain.com",
+					fmtLabel("%s.targetport"):  "443",
+					fmtLabel("%s.sni_routing"): "true",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# sni_routing ignored, caddy can't route TLS connections by SNI without terminating TLS\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:443\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithRobots(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.robots"):     "deny_all",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  header / X-Robots-Tag \"noindex, nofollow\"\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.robots")] = "passthrough"
+
+	const expectedPassthrough string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedPassthrough)
+
+	service.Spec.Labels[fmtLabel("%s.robots")] = "noindex"
+
+	const expectedInvalid string = "# Invalid robots \"noindex\", expected deny_all, allow_all or passthrough\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithNameOverride(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "stack_service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):               "staging.testdomain.com",
+					fmtLabel("%s.targetport"):            "5000",
+					fmtLabel("%s.service_name_override"): "staging_app",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "staging.testdomain.com {\n" +
+		"  proxy / staging_app:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	const expectedTasks string = "staging.testdomain.com {\n" +
+		"  proxy / tasks.staging_app:5000\n" +
+		"}\n"
+
+	testSingleService(t, true, service, expectedTasks)
+}
+
+func TestAddContainerWithLink(t *testing.T) {
+	var sidecar = &types.Container{
+		ID:    "SIDECAR-ID",
+		Names: []string{"/sidecar"},
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.3",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+	var container = &types.Container{
+		ID: "CONTAINER-ID",
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):    "service.testdomain.com",
+			fmtLabel("%s.targetport"): "5000",
+			fmtLabel("%s.link"):       "sidecar",
+		},
+	}
+
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.caddyNetworks = map[string]bool{caddyNetworkID: true}
+	generator.containersCache.containers = map[string]*types.Container{
+		sidecar.ID:   sidecar,
+		container.ID: container,
+	}
+
+	var buffer bytes.Buffer
+	generator.addContainerToCaddyFile(&buffer, container)
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.3:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expected, buffer.String())
+
+	container.Labels[fmtLabel("%s.link")] = "missing"
+	buffer.Reset()
+	generator.addContainerToCaddyFile(&buffer, container)
+
+	assert.Equal(t, "# Container CONTAINER-ID links to missing, which is not running\n", buffer.String())
+}
+
+func TestAddServiceWithTrustedProxiesCloudflare(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.realip" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                    "service.testdomain.com",
+					fmtLabel("%s.targetport"):                 "5000",
+					fmtLabel("%s.trusted_proxies_cloudflare"): "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  realip cloudflare\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	isPluginInstalled = func(name string) bool { return false }
+
+	const expectedNoPlugin string = "# trusted_proxies_cloudflare ignored, install the http.realip plugin to trust cloudflare\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedNoPlugin)
+}
+
+func TestAddServiceWithRequestLogCondition(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):               "service.testdomain.com",
+					fmtLabel("%s.targetport"):            "5000",
+					fmtLabel("%s.request_log_condition"): "status>=400",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# request_log_condition ignored, caddy log can't filter requests by status or latency, use caddy.log_skip_paths to exclude paths\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddContainerWithPreferIPv6(t *testing.T) {
+	var container = &types.Container{
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress:         "172.17.0.2",
+					GlobalIPv6Address: "fd00::2",
+					NetworkID:         caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):     "service.testdomain.com",
+			fmtLabel("%s.targetport"):  "5000",
+			fmtLabel("%s.prefer_ipv6"): "true",
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / [fd00::2]:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+
+	container.NetworkSettings.Networks["caddy-network"].GlobalIPv6Address = ""
+
+	const expectedIPv4 string = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expectedIPv4)
+}
+
+func TestAddServiceWithInternal(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):    "service.testdomain.com",
+					fmtLabel("%s.targetport"): "5000",
+					fmtLabel("%s.internal"):   "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  rewrite / {\n" +
+		"    if {remote} not_match \"^(10\\.|172\\.(1[6-9]|2[0-9]|3[01])\\.|192\\.168\\.|127\\.|::1$|f[cd])\"\n" +
+		"    to /caddy-docker-proxy-not-trusted\n" +
+		"  }\n" +
+		"  status 403 /caddy-docker-proxy-not-trusted\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.allow_path")] = "/api"
+
+	const expectedCombined string = "# Cannot combine internal with allow_path, caddy applies a single rewrite per request\n"
+
+	testSingleService(t, false, service, expectedCombined)
+}
+
+func TestAddServiceWithRedirectTrailingSlash(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                 "service.testdomain.com",
+					fmtLabel("%s.targetport"):              "5000",
+					fmtLabel("%s.redirect_trailing_slash"): "add",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  redir 301 {\n" +
+		"    / {path}/{?query}\n" +
+		"    if {path} not_ends_with /\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.redirect_trailing_slash")] = "remove"
+
+	const expectedRemove string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  # redirect_trailing_slash remove rewrites paths instead of redirecting, caddy redir can't remove the trailing slash\n" +
+		"  rewrite {\n" +
+		"    regex ^(.+)/$\n" +
+		"    to {1}\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedRemove)
+
+	service.Spec.Labels[fmtLabel("%s.request_transform.url")] = "^/v1/(.*) /api/v2/{1}"
+
+	const expectedConflict string = "# Cannot combine redirect_trailing_slash with request_transform.url, caddy applies a single rewrite per request\n"
+
+	testSingleService(t, false, service, expectedConflict)
+
+	delete(service.Spec.Labels, fmtLabel("%s.request_transform.url"))
+	service.Spec.Labels[fmtLabel("%s.redirect_trailing_slash")] = "always"
+
+	const expectedInvalid string = "# Invalid redirect_trailing_slash \"always\", expected add, remove or off\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestWrapScope(t *testing.T) {
+	content := wrapScope("node1", []byte("service.testdomain.com {\n  proxy / service:5000\n}\n"))
+
+	const expected string = "# scope:node1 begin\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n" +
+		"# scope:node1 end\n"
+
+	assert.Equal(t, expected, string(content))
+
+	assert.Equal(t, "# scope:node1 begin\n# Empty file\n# scope:node1 end\n", string(wrapScope("node1", []byte("# Empty file"))))
+}
+
+func TestAddServiceWithErrorHandlers(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):             "service.testdomain.com",
+					fmtLabel("%s.targetport"):          "5000",
+					fmtLabel("%s.error_handler.502"):   "/srv/maintenance.html",
+					fmtLabel("%s.error_handler_1.all"): "/srv/error.html",
+					fmtLabel("%s.error_handler_1.404"): "/srv/notfound.html",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  errors {\n" +
+		"    * /srv/error.html\n" +
+		"    404 /srv/notfound.html\n" +
+		"    502 /srv/maintenance.html\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.error_handler.502")] = "redir /maintenance.html temporary"
+
+	const expectedUnsupported string = "# error_handler.502 redir /maintenance.html temporary ignored, caddy error pages are static files, set the path of an error page file\n" +
+		"service.testdomain.com {\n" +
+		"  errors {\n" +
+		"    * /srv/error.html\n" +
+		"    404 /srv/notfound.html\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedUnsupported)
+}
+
+func TestAddServiceWithResponseTransform(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.filter" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                         "service.testdomain.com",
+					fmtLabel("%s.targetport"):                      "5000",
+					fmtLabel("%s.response_transform.find"):         "http://internal-service",
+					fmtLabel("%s.response_transform.replace"):      "https://public.example.com",
+					fmtLabel("%s.response_transform.content_type"): "application/json",
+					fmtLabel("%s.response_transform_1.find"):       "internal.local",
+					fmtLabel("%s.response_transform_1.replace"):    "example.com",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  filter rule {\n" +
+		"    content_type \"application/json\"\n" +
+		"    replacement \"https://public.example.com\"\n" +
+		"    search_pattern \"http://internal-service\"\n" +
+		"  }\n" +
+		"  filter rule {\n" +
+		"    path .*\n" +
+		"    replacement \"example.com\"\n" +
+		"    search_pattern \"internal\\.local\"\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	delete(service.Spec.Labels, fmtLabel("%s.response_transform_1.replace"))
+
+	const expectedInvalid string = "# Invalid response_transform, expected find and replace labels\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithRequestTransform(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                               "service.testdomain.com",
+					fmtLabel("%s.targetport"):                            "5000",
+					fmtLabel("%s.request_transform.url"):                 "^/v1/(.*) /api/v2/{1}",
+					fmtLabel("%s.request_transform.header.Content-Type"): "application/json",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream Content-Type \"application/json\"\n" +
+		"  }\n" +
+		"  rewrite {\n" +
+		"    regex ^/v1/(.*)\n" +
+		"    to /api/v2/{1}\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.request_transform.url")] = "/api/v2"
+
+	const expectedInvalid string = "# Invalid request_transform.url \"/api/v2\", expected a regex and a destination\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+
+	service.Spec.Labels[fmtLabel("%s.request_transform.url")] = "rewrite {path_regexp ^/v1/(.*) /api/v2/{http.regexp.1}}"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.rewrite")] = "/api /index.html"
+
+	const expectedConflict string = "# Cannot combine request_transform.url with rewrite, caddy applies a single rewrite per request\n"
+
+	testSingleService(t, false, service, expectedConflict)
+}
+
+func TestAddServiceWithGracefulDrain(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):        "service.testdomain.com",
+					fmtLabel("%s.targetport"):     "5000",
+					fmtLabel("%s.graceful_drain"): "30s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# graceful_drain ignored, caddy proxy can't drain upstreams, in-flight requests finish during graceful reloads limited by caddy -grace flag\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithXAccelRedirect(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):          "service.testdomain.com",
+					fmtLabel("%s.targetport"):       "5000",
+					fmtLabel("%s.x_accel_redirect"): "/var/www/files",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# x_accel_redirect ignored, caddy proxy can't serve files referenced by upstream response headers\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddContainerWithDefaultSite(t *testing.T) {
+	var container = &types.Container{
+		ID:      "CONTAINER-ID",
+		Created: 2,
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):      "service.testdomain.com",
+			fmtLabel("%s.targetport"):   "5000",
+			fmtLabel("%s.default_site"): "1",
+		},
+	}
+
+	const expected string = ":80 {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.caddyNetworks = map[string]bool{caddyNetworkID: true}
+	generator.defaultSiteID = generator.getDefaultSiteID([]types.Container{
+		*container,
+		types.Container{ID: "OLDER-ID", Created: 1, Labels: container.Labels},
+	}, nil)
+
+	var buffer bytes.Buffer
+	generator.addContainerToCaddyFile(&buffer, container)
+
+	const expectedIgnored string = "# Container CONTAINER-ID default_site ignored, OLDER-ID is the default site\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expectedIgnored, buffer.String())
+
+	container.Labels[fmtLabel("%s.port")] = "8080"
+
+	const expectedPort string = ":8080 {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expectedPort)
+}
+
+func TestDefaultSiteOfSuffixedSitesAndServices(t *testing.T) {
+	var container = &types.Container{
+		ID:      "CONTAINER-ID",
+		Created: 2,
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s_0.address"):      "service.testdomain.com",
+			fmtLabel("%s_0.targetport"):   "5000",
+			fmtLabel("%s_0.default_site"): "1",
+			fmtLabel("%s_1.address"):      "other.testdomain.com",
+			fmtLabel("%s_1.targetport"):   "6000",
+			fmtLabel("%s_1.default_site"): "1",
+		},
+	}
+	var service = &swarm.Service{
+		ID:   "SERVICE-ID",
+		Meta: swarm.Meta{CreatedAt: time.Unix(1, 0)},
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):      "service.testdomain.com",
+					fmtLabel("%s.targetport"):   "5000",
+					fmtLabel("%s.default_site"): "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.caddyNetworks = map[string]bool{caddyNetworkID: true}
+	generator.defaultSiteID = generator.getDefaultSiteID([]types.Container{*container}, []swarm.Service{*service})
+	assert.Equal(t, "CONTAINER-ID", generator.defaultSiteID)
+
+	var buffer bytes.Buffer
+	generator.addContainerToCaddyFile(&buffer, container)
+
+	const expectedContainer string = "# Container CONTAINER-ID caddy_1.default_site ignored, caddy_0.default_site is the default site\n" +
+		":80 {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n" +
+		"other.testdomain.com {\n" +
+		"  proxy / 172.17.0.2:6000\n" +
+		"}\n"
+
+	assert.Equal(t, expectedContainer, buffer.String())
+
+	buffer.Reset()
+	generator.addServiceToCaddyFile(&buffer, service)
+
+	const expectedService string = "# Service SERVICE-ID default_site ignored, CONTAINER-ID is the default site\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expectedService, buffer.String())
+
+	olderService := *service
+	olderService.ID = "OLDER-SERVICE-ID"
+	olderService.CreatedAt = time.Unix(0, 0)
+
+	assert.Equal(t, "OLDER-SERVICE-ID", generator.getDefaultSiteID(nil, []swarm.Service{*service, olderService}))
+}
+
+func TestAddServiceWithRateLimitBurst(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.ratelimit" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):          "service.testdomain.com",
+					fmtLabel("%s.targetport"):       "5000",
+					fmtLabel("%s.rate_limit.rate"):  "100r/s",
+					fmtLabel("%s.rate_limit.burst"): "150",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  ratelimit / 100 150 second\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	delete(service.Spec.Labels, fmtLabel("%s.rate_limit.burst"))
+	service.Spec.Labels[fmtLabel("%s.rate_limit")] = "/api"
+
+	const expectedDefault string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  ratelimit /api 100 200 second\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedDefault)
+
+	service.Spec.Labels[fmtLabel("%s.rate_limit.burst")] = "50"
+
+	const expectedInvalid string = "# Invalid rate_limit.burst \"50\", expected a number of requests not less than the rate\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithUpstreamIdleTimeout(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                        "service.testdomain.com",
+					fmtLabel("%s.targetport"):                     "5000",
+					fmtLabel("%s.upstream_idle_timeout"):          "10",
+					fmtLabel("%s.upstream_idle_timeout.duration"): "90s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # upstream_idle_timeout.duration 90s ignored, caddy proxy doesn't support configuring keepalive idle time\n" +
+		"  proxy / service:5000 {\n" +
+		"    keepalive 10\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.upstream_idle_timeout")] = "many"
+
+	const expectedInvalid string = "# Invalid upstream_idle_timeout \"many\", expected a number of idle connections\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+
+	service.Spec.Labels[fmtLabel("%s.upstream_idle_timeout")] = "10"
+	service.Spec.Labels[fmtLabel("%s.keepalive.pool_size")] = "20"
+
+	const expectedConflict string = "# Cannot combine upstream_idle_timeout with another label setting the proxy keepalive\n"
+
+	testSingleService(t, false, service, expectedConflict)
+}
+
+func TestAddServiceWithHealthCheck(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):              "service.testdomain.com",
+					fmtLabel("%s.targetport"):           "5000",
+					fmtLabel("%s.healthcheck_path"):     "/health",
+					fmtLabel("%s.healthcheck_interval"): "10s",
+					fmtLabel("%s.healthcheck_timeout"):  "2s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    health_check /health\n" +
+		"    health_check_interval 10s\n" +
+		"    health_check_timeout 2s\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels = map[string]string{
+		fmtLabel("%s.address"):             "service.testdomain.com",
+		fmtLabel("%s.targetport"):          "5000",
+		fmtLabel("%s.probe_path"):          "/health",
+		fmtLabel("%s.probe_interval"):      "10s",
+		fmtLabel("%s.probe_timeout"):       "2s",
+		fmtLabel("%s.probe_expect_status"): "204",
+	}
+
+	const expectedProbe string = "service.testdomain.com {\n" +
+		"  # healthcheck_expect_status 204 ignored, caddy proxy health checks accept any 2xx or 3xx status\n" +
+		"  proxy / service:5000 {\n" +
+		"    health_check /health\n" +
+		"    health_check_interval 10s\n" +
+		"    health_check_timeout 2s\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedProbe)
+
+	delete(service.Spec.Labels, fmtLabel("%s.probe_path"))
+
+	const expectedInvalid string = "# Cannot configure health checks without healthcheck_path\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddContainerWithStartupProbe(t *testing.T) {
+	var container = &types.Container{
+		ID: "CONTAINER-ID",
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):               "service.testdomain.com",
+			fmtLabel("%s.targetport"):            "5000",
+			fmtLabel("%s.startup_probe.path"):    "/ready",
+			fmtLabel("%s.startup_probe.timeout"): "10s",
+		},
+	}
+
+	probed := make(chan string, 1)
+	originalCheckStartupProbe := checkStartupProbe
+	checkStartupProbe = func(url string) bool {
+		probed <- url
+		return true
+	}
+	defer func() { checkStartupProbe = originalCheckStartupProbe }()
+
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.caddyNetworks = map[string]bool{}
+	generator.caddyNetworks[caddyNetworkID] = true
+
+	var buffer bytes.Buffer
+	generator.addContainerToCaddyFile(&buffer, container)
+	assert.Equal(t, "# Container CONTAINER-ID waiting for startup probe\n", buffer.String())
+	select {
+	case url := <-probed:
+		assert.Equal(t, "http://172.17.0.2:5000/ready", url)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Startup probe wasn't checked")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buffer.Reset()
+		generator.addContainerToCaddyFile(&buffer, container)
+		if !strings.Contains(buffer.String(), "waiting for startup probe") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Container still waiting for startup probe after it succeeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / 172.17.0.2:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestAddContainerWithStartupProbeOnProxyTarget(t *testing.T) {
+	var container = &types.Container{
+		ID: "CONTAINER-ID",
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress:         "172.17.0.2",
+					GlobalIPv6Address: "fd00::2",
+					NetworkID:         caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):            "service.testdomain.com",
+			fmtLabel("%s.targetport"):         "5000",
+			fmtLabel("%s.prefer_ipv6"):        "true",
+			fmtLabel("%s.startup_probe.path"): "/ready",
+		},
+	}
+
+	probed := make(chan string, 1)
+	originalCheckStartupProbe := checkStartupProbe
+	checkStartupProbe = func(url string) bool {
+		probed <- url
+		return true
+	}
+	defer func() { checkStartupProbe = originalCheckStartupProbe }()
+
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+	})
+	generator.caddyNetworks = map[string]bool{}
+	generator.caddyNetworks[caddyNetworkID] = true
+
+	var buffer bytes.Buffer
+	generator.addContainerToCaddyFile(&buffer, container)
+
+	select {
+	case url := <-probed:
+		assert.Equal(t, "http://[fd00::2]:5000/ready", url)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Startup probe wasn't checked")
+	}
+}
+
+func TestAddServiceWithHostHeader(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):     "service.testdomain.com",
+					fmtLabel("%s.targetport"):  "5000",
+					fmtLabel("%s.host_header"): "backend.internal",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream Host \"backend.internal\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.host_header")] = "{http.request.host}"
+
+	const expectedPassThrough string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream Host {host}\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedPassThrough)
+
+	service.Spec.Labels[fmtLabel("%s.host_header")] = "upstream"
+
+	const expectedUpstream string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedUpstream)
+}
+
+func TestAddServiceWithExcludeFromGlobalHeaders(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                     "service.testdomain.com",
+					fmtLabel("%s.targetport"):                  "5000",
+					fmtLabel("%s.exclude_from_global_headers"): "Strict-Transport-Security X-Content-Type-Options",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  header / {\n" +
+		"    -Strict-Transport-Security\n" +
+		"    -X-Content-Type-Options\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestLabelFilterArgs(t *testing.T) {
+	args := labelFilterArgs("com.docker.stack.namespace=production")
+	assert.Equal(t, []string{"com.docker.stack.namespace=production"}, args.Get("label"))
+
+	args = labelFilterArgs("")
+	assert.Empty(t, args.Get("label"))
+}
+
+func TestAddContainerWithStaticFileServer(t *testing.T) {
+	var container = &types.Container{
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"caddy-network": &network.EndpointSettings{
+					IPAddress: "172.17.0.2",
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+		Labels: map[string]string{
+			fmtLabel("%s.address"):            "static.testdomain.com",
+			fmtLabel("%s.static_file_server"): "/data/www/myapp",
+		},
+	}
+
+	const expected string = "static.testdomain.com {\n" +
+		"  root /data/www/myapp\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expected)
+
+	container.Labels[fmtLabel("%s.targetport")] = "5000"
+
+	const expectedTargetPort string = "# targetport ignored, static_file_server serves files without proxy\n" +
+		"static.testdomain.com {\n" +
+		"  root /data/www/myapp\n" +
+		"}\n"
+
+	testSingleContainer(t, container, expectedTargetPort)
+}
+
+func TestAddServiceWithTLSServerName(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):         "service.testdomain.com",
+					fmtLabel("%s.targetport"):      "5000",
+					fmtLabel("%s.tls_server_name"): "cdn-backend.example.com",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# tls_server_name ignored, caddy proxy sends the upstream address as TLS server name, use a target that matches the upstream certificate\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithStripProxyHeaders(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):             "service.testdomain.com",
+					fmtLabel("%s.targetport"):          "5000",
+					fmtLabel("%s.strip_proxy_headers"): "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream -X-Forwarded-For\n" +
+		"    header_upstream -X-Forwarded-Host\n" +
+		"    header_upstream -X-Forwarded-Proto\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.strip_proxy_headers")] = "X-Forwarded-For"
+
+	const expectedSelective string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream -X-Forwarded-For\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedSelective)
+}
+
+func TestAddServiceWithContentLengthLimit(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):              "service.testdomain.com",
+					fmtLabel("%s.targetport"):           "5000",
+					fmtLabel("%s.content_length_limit"): "100MB",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# content_length_limit ignored, caddy limits can only limit request bodies, not upstream responses\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithHideHeaders(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):      "service.testdomain.com",
+					fmtLabel("%s.targetport"):   "5000",
+					fmtLabel("%s.hide_headers"): "Authorization X-Internal-Token",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream -Authorization\n" +
+		"    header_upstream -X-Internal-Token\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithPathMatcher(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):      "service.testdomain.com",
+					fmtLabel("%s.targetport"):   "5000",
+					fmtLabel("%s.path_matcher"): "path_regexp ^/api/v[0-9]+/",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  rewrite {\n" +
+		"    if {path} not_match \"^/api/v[0-9]+/\"\n" +
+		"    to /caddy-docker-proxy-not-allowed\n" +
+		"  }\n" +
+		"  status 404 /caddy-docker-proxy-not-allowed\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.path_matcher")] = "host api.example.com"
+
+	const expectedInvalid string = "# Invalid path_matcher \"host api.example.com\", expected path_regexp <regexp>\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+	service.Spec.Labels[fmtLabel("%s.path_matcher")] = "path_regexp ^/api/v[0-9]+/"
+	service.Spec.Labels[fmtLabel("%s.allow_path")] = "/health"
+
+	const expectedCombined string = "# Cannot combine path_matcher with allow_path, caddy applies a single rewrite per request\n"
+
+	testSingleService(t, false, service, expectedCombined)
+}
+
+func TestAddServiceWithRequestRate(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.ratelimit" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):      "service.testdomain.com",
+					fmtLabel("%s.targetport"):   "5000",
+					fmtLabel("%s.request_rate"): "50r/m",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"  ratelimit / 50 100 minute\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.request_rate")] = "50/m"
+
+	const expectedInvalid string = "# Invalid request_rate \"50/m\", expected a rate like 50r/m\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+
+	service.Spec.Labels[fmtLabel("%s.request_rate")] = "50r/m"
+	service.Spec.Labels[fmtLabel("%s.rate_limit")] = "/api 10 20 second"
+
+	const expectedCombined string = "# Cannot combine request_rate with rate_limit labels\n"
+
+	testSingleService(t, false, service, expectedCombined)
+}
+
+func TestAddServiceWithLogRequestBody(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                       "service.testdomain.com",
+					fmtLabel("%s.targetport"):                    "5000",
+					fmtLabel("%s.log_request_body"):              "1",
+					fmtLabel("%s.log_request_body.max_bytes"):    "1024",
+					fmtLabel("%s.log_request_body.content_type"): "application/json",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # WARNING: request bodies are logged and may expose passwords, tokens and personal data, use log_request_body only for debugging\n" +
+		"  # log_request_body.max_bytes 1024 ignored, caddy logs up to 100KB of request bodies\n" +
+		"  log / stdout \"{common} {request_body}\"\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	delete(service.Spec.Labels, fmtLabel("%s.log_request_body.max_bytes"))
+	service.Spec.Labels[fmtLabel("%s.access_log_format")] = "json"
+	service.Spec.Labels[fmtLabel("%s.access_log_format.fields")] = "method uri"
+
+	const expectedJSON string = "service.testdomain.com {\n" +
+		"  # WARNING: request bodies are logged and may expose passwords, tokens and personal data, use log_request_body only for debugging\n" +
+		"  log / stdout \"\\{\\\"method\\\":\\\"{method}\\\",\\\"uri\\\":\\\"{uri}\\\",\\\"request_body\\\":\\\"{request_body}\\\"\\}\"\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedJSON)
+}
+
+func TestAddServiceWithCORSPreflightMaxAge(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "service.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.cors.origin"):            "https://app.example.com",
+					fmtLabel("%s.cors.methods"):           "GET,POST",
+					fmtLabel("%s.cors.preflight_max_age"): "7200",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  cors {\n" +
+		"    max_age 7200\n" +
+		"    methods GET,POST\n" +
+		"    origin https://app.example.com\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithRewriteResponseHeaders(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                                   "service.testdomain.com",
+					fmtLabel("%s.targetport"):                                "5000",
+					fmtLabel("%s.rewrite_response_headers.Location"):         "s|http://internal-app:8080|https://public.example.com|g",
+					fmtLabel("%s.rewrite_response_headers.Content-Location"): `s#^/app/(.*)$#/\1#`,
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_downstream Content-Location \"^/app/(.*)$\" \"/${1}\"\n" +
+		"    header_downstream Location \"http://internal-app:8080\" \"https://public.example.com\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.rewrite_response_headers.Location")] = "http://public.example.com"
+
+	const expectedInvalid string = "# Invalid rewrite_response_headers.Location \"http://public.example.com\", expected s|find|replace|g\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithUpstreamCompression(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):              "service.testdomain.com",
+					fmtLabel("%s.targetport"):           "5000",
+					fmtLabel("%s.upstream_compression"): "1",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # upstream_compression forwards compressed responses as is, clients must accept gzip, deflate and br\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream Accept-Encoding \"gzip,deflate,br\"\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.upstream_compression")] = "off"
+
+	const expectedOff string = "service.testdomain.com {\n" +
+		"  proxy / service:5000 {\n" +
+		"    header_upstream -Accept-Encoding\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedOff)
+
+	service.Spec.Labels[fmtLabel("%s.upstream_compression")] = "br"
+
+	const expectedInvalid string = "# Invalid upstream_compression \"br\", expected 1 or off\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithMetricsLabels(t *testing.T) {
+	defer func(original func(string) bool) { isPluginInstalled = original }(isPluginInstalled)
+	isPluginInstalled = func(name string) bool { return name == "http.prometheus" }
+
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):               "service.testdomain.com",
+					fmtLabel("%s.targetport"):            "5000",
+					fmtLabel("%s.metrics_label.service"): "myapp",
+					fmtLabel("%s.metrics_label.env"):     "production",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  prometheus {\n" +
+		"    label env \"production\"\n" +
+		"    label service \"myapp\"\n" +
+		"  }\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	isPluginInstalled = func(name string) bool { return false }
+
+	const expectedWithoutPlugin string = "# metrics_label ignored, install the http.prometheus plugin to expose metrics\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expectedWithoutPlugin)
+}
+
+func TestAddServiceWithLogSampling(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                 "service.testdomain.com",
+					fmtLabel("%s.targetport"):              "5000",
+					fmtLabel("%s.log_sampling_first"):      "10",
+					fmtLabel("%s.log_sampling_thereafter"): "100",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# log_sampling_first ignored, caddy log doesn't support sampling, use caddy.log_skip_paths to exclude noisy paths\n" +
+		"# log_sampling_thereafter ignored, caddy log doesn't support sampling, use caddy.log_skip_paths to exclude noisy paths\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+type slowTemplateData struct {
+	release chan struct{}
+}
+
+func (d slowTemplateData) Slow() string {
+	<-d.release
+	return "slow"
+}
+
+func TestProcessVariablesTimeout(t *testing.T) {
+	data := slowTemplateData{release: make(chan struct{})}
+	defer close(data.release)
+
+	assert.Equal(t, "{{.Slow}}", processVariables(data, "{{.Slow}}", 10*time.Millisecond))
+	assert.Equal(t, "fast", processVariables(data, "fast", time.Second))
+}
+
+func TestAddServiceWithUpstreamKeepaliveCount(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                     "service.testdomain.com",
+					fmtLabel("%s.targetport"):                  "5000",
+					fmtLabel("%s.upstream_keepalive_count"):    "32",
+					fmtLabel("%s.upstream_keepalive_interval"): "30s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  # upstream_keepalive_interval 30s ignored, caddy proxy doesn't support configuring the connection pool cleanup\n" +
+		"  proxy / service:5000 {\n" +
+		"    keepalive 32\n" +
+		"  }\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.upstream_keepalive_count")] = "many"
+
+	const expectedInvalid string = "# Invalid upstream_keepalive_count \"many\", expected a number of idle connections\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+
+	service.Spec.Labels[fmtLabel("%s.upstream_keepalive_count")] = "32"
+	service.Spec.Labels[fmtLabel("%s.upstream_idle_timeout")] = "10"
+
+	const expectedConflict string = "# Cannot combine upstream_keepalive_count with another label setting the proxy keepalive\n"
+
+	testSingleService(t, false, service, expectedConflict)
+}
+
+func TestAddServiceWithAbortOnError(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):               "service.testdomain.com",
+					fmtLabel("%s.targetport"):            "5000",
+					fmtLabel("%s.abort_on_error"):        "1",
+					fmtLabel("%s.abort_on_error.status"): "401 403",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# abort_on_error ignored, caddy can't close connections on errors, use caddy.error_handler to serve generic error pages\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
+func TestAddServiceWithGracefulShutdownTimeout(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                   "service.testdomain.com",
+					fmtLabel("%s.targetport"):                "5000",
+					fmtLabel("%s.timeout.graceful_shutdown"): "30s",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "# timeout.graceful_shutdown 30s ignored, caddy grace period applies to all sites, start caddy with -grace 30s\n" +
+		"service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	service.Spec.Labels[fmtLabel("%s.timeout.graceful_shutdown")] = "30"
+
+	const expectedInvalid string = "# Invalid timeout.graceful_shutdown \"30\", expected a duration like 500ms\n"
+
+	testSingleService(t, false, service, expectedInvalid)
+}
+
+func TestAddServiceWithTaskIPsDiscoveryMode(t *testing.T) {
+	tasks := []swarm.Task{
+		swarm.Task{
+			Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{
+				swarm.NetworkAttachment{Network: swarm.Network{ID: caddyNetworkID}, Addresses: []string{"10.0.0.7/24"}},
+			},
+		},
+		swarm.Task{
+			Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{
+				swarm.NetworkAttachment{Network: swarm.Network{ID: "other-network"}, Addresses: []string{"10.1.0.9/24"}},
+				swarm.NetworkAttachment{Network: swarm.Network{ID: caddyNetworkID}, Addresses: []string{"10.0.0.6/24"}},
+			},
+		},
+		swarm.Task{
+			Status: swarm.TaskStatus{State: swarm.TaskStateShutdown},
+			NetworksAttachments: []swarm.NetworkAttachment{
+				swarm.NetworkAttachment{Network: swarm.Network{ID: caddyNetworkID}, Addresses: []string{"10.0.0.8/24"}},
+			},
+		},
+		swarm.Task{
+			Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{
+				swarm.NetworkAttachment{Network: swarm.Network{ID: "other-network"}, Addresses: []string{"10.1.0.10/24"}},
+			},
+		},
+	}
+	originalListServiceTasks := listServiceTasks
+	listServiceTasks = func(dockerClient *client.Client, serviceID string) ([]swarm.Task, error) {
+		return tasks, nil
+	}
+	defer func() { listServiceTasks = originalListServiceTasks }()
+
+	var service = &swarm.Service{
+		ID: "SERVICE-ID",
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "service.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.service_discovery_mode"): "task_ips",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / 10.0.0.6:5000 10.0.0.7:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+
+	tasks = tasks[2:]
+
+	const expectedNoTasks string = "# Service SERVICE-ID has no running tasks in caddy network\n"
+
+	testSingleService(t, false, service, expectedNoTasks)
+}
+
+func TestAddServiceWithoutVirtualIPs(t *testing.T) {
+	originalListServiceTasks := listServiceTasks
+	listServiceTasks = func(dockerClient *client.Client, serviceID string) ([]swarm.Task, error) {
+		return []swarm.Task{
+			swarm.Task{
+				Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+				NetworksAttachments: []swarm.NetworkAttachment{
+					swarm.NetworkAttachment{Network: swarm.Network{ID: caddyNetworkID}, Addresses: []string{"10.0.0.7/24"}},
+				},
+			},
+		}, nil
+	}
+	defer func() { listServiceTasks = originalListServiceTasks }()
+
+	var service = &swarm.Service{
+		ID: "SERVICE-ID",
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					fmtLabel("%s.address"):                "service.testdomain.com",
+					fmtLabel("%s.targetport"):             "5000",
+					fmtLabel("%s.service_discovery_mode"): "ip",
+				},
+			},
+		},
+	}
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / 10.0.0.7:5000\n" +
+		"}\n"
+
+	testSingleService(t, false, service, expected)
+}
+
 func testSingleService(t *testing.T, shouldProxyServiceTasks bool, service *swarm.Service, expected string) {
 	var buffer bytes.Buffer
 	generator := CreateGenerator(nil, &GeneratorOptions{
@@ -75,6 +75,7 @@ func (dockerLoader *DockerLoader) monitorEvents() {
 	args.Add("scope", "local")
 	args.Add("type", "service")
 	args.Add("type", "container")
+	args.Add("type", "network")
 
 	eventsChan, errorChan := dockerLoader.dockerClient.Events(context.Background(), types.EventsOptions{
 		Filters: args,
@@ -83,12 +84,21 @@ func (dockerLoader *DockerLoader) monitorEvents() {
 	for {
 		select {
 		case event := <-eventsChan:
+			if event.Type == "container" {
+				dockerLoader.generator.UpdateContainer(event.Action, event.Actor.ID)
+			}
+			if event.Type == "network" {
+				dockerLoader.generator.UpdateContainer(event.Action, event.Actor.Attributes["container"])
+			}
+
 			if dockerLoader.skipEvents {
 				continue
 			}
 
 			update := (event.Type == "container" && event.Action == "start") ||
 				(event.Type == "container" && event.Action == "stop") ||
+				(event.Type == "network" && event.Action == "connect") ||
+				(event.Type == "network" && event.Action == "disconnect") ||
 				(event.Type == "service" && event.Action == "create") ||
 				(event.Type == "service" && event.Action == "update") ||
 				(event.Type == "service" && event.Action == "remove")
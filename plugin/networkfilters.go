@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"github.com/docker/docker/api/types"
+)
+
+// NetworkFilter returns true for caddy networks that should be used to reach containers and services
+type NetworkFilter func(networkInfo types.NetworkResource) bool
+
+// ExcludeIngress skips the swarm ingress network
+func ExcludeIngress(networkInfo types.NetworkResource) bool {
+	return !networkInfo.Ingress
+}
+
+// ExcludeHostNetwork skips networks using the host driver
+func ExcludeHostNetwork(networkInfo types.NetworkResource) bool {
+	return networkInfo.Driver != "host"
+}
+
+// ExcludeGwBridge skips the docker_gwbridge network used by swarm
+func ExcludeGwBridge(networkInfo types.NetworkResource) bool {
+	return networkInfo.Name != "docker_gwbridge"
+}
+
+// AllNetworkFilters combines filters, keeping networks accepted by all of them
+func AllNetworkFilters(filters ...NetworkFilter) NetworkFilter {
+	return func(networkInfo types.NetworkResource) bool {
+		for _, filter := range filters {
+			if !filter(networkInfo) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,25 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkFilters(t *testing.T) {
+	ingress := types.NetworkResource{Name: "ingress", Driver: "overlay", Ingress: true}
+	host := types.NetworkResource{Name: "host", Driver: "host"}
+	gwBridge := types.NetworkResource{Name: "docker_gwbridge", Driver: "bridge"}
+	caddy := types.NetworkResource{Name: "caddy", Driver: "overlay"}
+
+	filter := AllNetworkFilters(ExcludeIngress, ExcludeHostNetwork, ExcludeGwBridge)
+
+	assert.False(t, filter(ingress))
+	assert.False(t, filter(host))
+	assert.False(t, filter(gwBridge))
+	assert.True(t, filter(caddy))
+
+	assert.True(t, ExcludeIngress(host))
+	assert.True(t, ExcludeHostNetwork(gwBridge))
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+const defaultStartupProbeTimeout = time.Minute
+const startupProbeInterval = time.Second
+
+// startupProbes tracks containers waiting for their startup endpoint to respond,
+// probes run in background and containers are added on the next update after they succeed
+type startupProbes struct {
+	sync.Mutex
+	probes map[string]*startupProbe
+}
+
+type startupProbe struct {
+	ready  bool
+	failed bool
+}
+
+// checkStartupProbe returns true when url responds 200
+var checkStartupProbe = func(url string) bool {
+	client := http.Client{Timeout: 2 * time.Second}
+	response, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK
+}
+
+// isContainerStarted returns true when the container has no startup probe or its
+// startup probe succeeded, starting the probe the first time the container is seen
+func (g *CaddyfileGenerator) isContainerStarted(container *types.Container, labels map[string]string) (bool, error) {
+	path, ok := labels[g.labelPrefix+".startup_probe.path"]
+	if !ok {
+		return true, nil
+	}
+
+	probes := g.startupProbes
+	probes.Lock()
+	defer probes.Unlock()
+
+	if probe := probes.probes[container.ID]; probe != nil {
+		if probe.failed {
+			return false, fmt.Errorf("Container %v startup probe failed", container.ID)
+		}
+		return probe.ready, nil
+	}
+
+	timeout := defaultStartupProbeTimeout
+	if timeoutLabel, ok := labels[g.labelPrefix+".startup_probe.timeout"]; ok {
+		var err error
+		if timeout, err = time.ParseDuration(timeoutLabel); err != nil {
+			return false, fmt.Errorf("Invalid startup_probe.timeout %q, expected a duration like 500ms", timeoutLabel)
+		}
+	}
+	port, ok := labels[g.labelPrefix+".targetport"]
+	if !ok {
+		return false, fmt.Errorf("Container %v startup probe requires a targetport", container.ID)
+	}
+	targets, err := g.getContainerProxyTargets(container, labels)
+	if err != nil {
+		return false, err
+	}
+
+	probe := &startupProbe{}
+	probes.probes[container.ID] = probe
+	go g.runStartupProbe(container.ID, probe, fmt.Sprintf("http://%s:%s%s", targets[0], port, path), timeout)
+	return false, nil
+}
+
+func (g *CaddyfileGenerator) runStartupProbe(containerID string, probe *startupProbe, url string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ready := checkStartupProbe(url)
+		if ready || time.Now().After(deadline) {
+			g.startupProbes.Lock()
+			probe.ready = ready
+			probe.failed = !ready
+			g.startupProbes.Unlock()
+			if !ready {
+				log.Printf("[WARNING] Container %v startup probe %v didn't respond 200 within %v\n", containerID, url, timeout)
+			}
+			return
+		}
+		time.Sleep(startupProbeInterval)
+	}
+}
+
+// removeStartupProbe forgets the probe of a container, probing it again when it restarts
+func (g *CaddyfileGenerator) removeStartupProbe(containerID string) {
+	g.startupProbes.Lock()
+	defer g.startupProbes.Unlock()
+
+	delete(g.startupProbes.probes, containerID)
+}
@@ -0,0 +1,34 @@
+package plugin
+
+import (
+	"strings"
+)
+
+// LabelTransformer transforms labels before they are converted to directives
+type LabelTransformer interface {
+	Transform(labels map[string]string) map[string]string
+}
+
+// PrefixMappingTransformer renames label prefixes, allowing custom label conventions
+type PrefixMappingTransformer struct {
+	// Mappings maps custom prefixes to caddy label prefixes
+	Mappings map[string]string
+}
+
+// Transform replaces mapped prefixes, keeping other labels unchanged
+func (t *PrefixMappingTransformer) Transform(labels map[string]string) map[string]string {
+	transformed := map[string]string{}
+	for label, value := range labels {
+		transformed[t.mapLabel(label)] = value
+	}
+	return transformed
+}
+
+func (t *PrefixMappingTransformer) mapLabel(label string) string {
+	for from, to := range t.Mappings {
+		if label == from || strings.HasPrefix(label, from+".") || strings.HasPrefix(label, from+"_") {
+			return to + strings.TrimPrefix(label, from)
+		}
+	}
+	return label
+}
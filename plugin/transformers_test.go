@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixMappingTransformer(t *testing.T) {
+	transformer := &PrefixMappingTransformer{
+		Mappings: map[string]string{
+			"com.example.proxy": "caddy",
+		},
+	}
+
+	transformed := transformer.Transform(map[string]string{
+		"com.example.proxy":            "service.testdomain.com",
+		"com.example.proxy.targetport": "5000",
+		"com.example.proxy_1.address":  "other.testdomain.com",
+		"com.example.proxyversion":     "1",
+		"caddy.gzip":                   "",
+	})
+
+	assert.Equal(t, map[string]string{
+		"caddy":                    "service.testdomain.com",
+		"caddy.targetport":         "5000",
+		"caddy_1.address":          "other.testdomain.com",
+		"com.example.proxyversion": "1",
+		"caddy.gzip":               "",
+	}, transformed)
+}
+
+func TestGeneratorAppliesLabelTransformers(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					"proxy.address":    "service.testdomain.com",
+					"proxy.targetport": "5000",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	var buffer bytes.Buffer
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+		LabelTransformers: []LabelTransformer{
+			&PrefixMappingTransformer{Mappings: map[string]string{"proxy": "caddy"}},
+		},
+	})
+	generator.caddyNetworks = map[string]bool{}
+	generator.caddyNetworks[caddyNetworkID] = true
+	generator.addServiceToCaddyFile(&buffer, service)
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / service:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expected, buffer.String())
+}
+
+func TestGeneratorAppliesLabelTransformersToControlLabels(t *testing.T) {
+	var service = &swarm.Service{
+		Spec: swarm.ServiceSpec{
+			Annotations: swarm.Annotations{
+				Name: "service",
+				Labels: map[string]string{
+					"myorg.address":               "service.testdomain.com",
+					"myorg.targetport":            "5000",
+					"myorg.service_policy":        "tasks",
+					"myorg.service_name_override": "backend",
+				},
+			},
+		},
+		Endpoint: swarm.Endpoint{
+			VirtualIPs: []swarm.EndpointVirtualIP{
+				swarm.EndpointVirtualIP{
+					NetworkID: caddyNetworkID,
+				},
+			},
+		},
+	}
+
+	var buffer bytes.Buffer
+	generator := CreateGenerator(nil, &GeneratorOptions{
+		labelPrefix: defaultLabelPrefix,
+		LabelTransformers: []LabelTransformer{
+			&PrefixMappingTransformer{Mappings: map[string]string{"myorg": "caddy"}},
+		},
+	})
+	generator.caddyNetworks = map[string]bool{}
+	generator.caddyNetworks[caddyNetworkID] = true
+	generator.addServiceToCaddyFile(&buffer, service)
+
+	const expected string = "service.testdomain.com {\n" +
+		"  proxy / tasks.backend:5000\n" +
+		"}\n"
+
+	assert.Equal(t, expected, buffer.String())
+}